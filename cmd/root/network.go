@@ -0,0 +1,388 @@
+/*
+
+Copyright 2020 Salvatore Mazzarino
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package root
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/giantswarm/containervmm/pkg/api"
+	"github.com/giantswarm/containervmm/pkg/control"
+	"github.com/giantswarm/containervmm/pkg/ignition"
+	"github.com/giantswarm/containervmm/pkg/network"
+)
+
+// setupNetwork connects the guest to the network of the container as
+// requested by the network mode. The changes made to the network of the
+// container are returned, to be reverted once the guest is gone.
+func setupNetwork(guest *api.Guest, server *control.Server) (*network.Changes, error) {
+	guest.NetworkMode = api.NetworkMode(c.GetString(cfgNetworkMode))
+
+	for _, p := range c.GetStringSlice(cfgNetworkPublish) {
+		portMapping, err := parsePublishFlag(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid published port %q: %v", p, err)
+		}
+
+		guest.PortMappings = append(guest.PortMappings, portMapping)
+	}
+
+	switch guest.NetworkMode {
+	case api.NetworkModeUser:
+		// QEMU serves DHCP and DNS to the guest and forwards its traffic
+		// through the sockets of the container, which keeps its addresses
+		if len(c.GetStringSlice(cfgGuestDNSServers)) > 0 || len(c.GetStringSlice(cfgGuestNTPServers)) > 0 {
+			log.Warningf("The DNS and NTP servers are ignored in %s network mode", guest.NetworkMode)
+		}
+
+		if c.GetString(cfgGuestNetworkConfig) != guestNetworkConfigDHCP {
+			log.Warningf("The guest network configuration is served by QEMU in %s network mode", guest.NetworkMode)
+		}
+
+		if c.GetBool(cfgNetworkAntiSpoofing) {
+			log.Warningf("The anti-spoofing filters are ignored in %s network mode, QEMU sends the traffic of the guest", guest.NetworkMode)
+		}
+
+		if len(c.GetStringSlice(cfgNetworkIngressLimit)) > 0 || len(c.GetStringSlice(cfgNetworkEgressLimit)) > 0 {
+			log.Warningf("The bandwidth limits are ignored in %s network mode, the guest has no TAP device", guest.NetworkMode)
+		}
+
+		if len(c.GetStringSlice(cfgCaptureInterfaces)) > 0 {
+			log.Warningf("The traffic of the guest is not captured in %s network mode, the guest has no TAP device", guest.NetworkMode)
+		}
+
+		return &network.Changes{}, nil
+	case api.NetworkModeNAT:
+	case api.NetworkModeBridge, api.NetworkModeMACVTAP:
+		if len(guest.PortMappings) > 0 {
+			return nil, fmt.Errorf("--%s is only supported with --%s=%s or %s, the guest owns the addresses of the container otherwise",
+				cfgNetworkPublish, cfgNetworkMode, api.NetworkModeUser, api.NetworkModeNAT)
+		}
+
+		if guest.NetworkMode == api.NetworkModeMACVTAP && c.GetBool(cfgNetworkAntiSpoofing) {
+			return nil, fmt.Errorf("--%s is only supported with --%s=%s or %s, the guest is not behind a bridge otherwise",
+				cfgNetworkAntiSpoofing, cfgNetworkMode, api.NetworkModeBridge, api.NetworkModeNAT)
+		}
+
+		if guest.NetworkMode == api.NetworkModeMACVTAP && (len(c.GetStringSlice(cfgNetworkIngressLimit)) > 0 || len(c.GetStringSlice(cfgNetworkEgressLimit)) > 0) {
+			return nil, fmt.Errorf("--%s and --%s are only supported with --%s=%s or %s, the traffic of the macvtap devices bypasses their qdiscs",
+				cfgNetworkIngressLimit, cfgNetworkEgressLimit, cfgNetworkMode, api.NetworkModeBridge, api.NetworkModeNAT)
+		}
+
+		if guest.NetworkMode == api.NetworkModeMACVTAP && len(c.GetStringSlice(cfgCaptureInterfaces)) > 0 {
+			return nil, fmt.Errorf("--%s is only supported with --%s=%s or %s, the traffic received by the macvtap devices bypasses their packet sockets",
+				cfgCaptureInterfaces, cfgNetworkMode, api.NetworkModeBridge, api.NetworkModeNAT)
+		}
+	default:
+		return nil, fmt.Errorf("unknown network mode %q", guest.NetworkMode)
+	}
+
+	var dhcpIfaces []network.DHCPInterface
+	var changes *network.Changes
+
+	if guest.NetworkMode == api.NetworkModeNAT {
+		// the container keeps its interfaces, the guest is behind a
+		// bridge of its own
+		_, subnet, err := net.ParseCIDR(c.GetString(cfgNetworkNATSubnet))
+		if err != nil {
+			return nil, fmt.Errorf("invalid NAT subnet: %v", err)
+		}
+
+		if dhcpIfaces, changes, err = network.SetupNAT(guest, subnet); err != nil {
+			return nil, fmt.Errorf("an error occured during the the setup of the network: %v", err)
+		}
+	} else {
+		// Setup networking inside of the container, return the available interfaces
+		filter := network.InterfaceFilter{
+			Include:           c.GetStringSlice(cfgNetworkInclude),
+			Exclude:           c.GetStringSlice(cfgNetworkExclude),
+			MultusNetworks:    c.GetStringSlice(cfgNetworkMultusNetworks),
+			MultusAnnotations: c.GetString(cfgNetworkMultusAnnotations),
+		}
+
+		var err error
+		if dhcpIfaces, changes, err = network.SetupInterfaces(guest, filter); err != nil {
+			return nil, fmt.Errorf("an error occured during the the setup of the network: %v", err)
+		}
+	}
+
+	if c.GetBool(cfgNetworkAntiSpoofing) {
+		if err := network.AddAntiSpoofingRules(guest.NICs, changes); err != nil {
+			changes.Revert()
+
+			return nil, err
+		}
+	}
+
+	if err := limitBandwidth(guest, changes, server); err != nil {
+		changes.Revert()
+
+		return nil, err
+	}
+
+	if err := startCapture(guest, server); err != nil {
+		changes.Revert()
+
+		return nil, err
+	}
+
+	if err := configureGuestNetwork(guest, dhcpIfaces); err != nil {
+		changes.Revert()
+
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// limitBandwidth shapes the traffic of the NICs of the guest, the limits
+// being changed at runtime through the control API
+func limitBandwidth(guest *api.Guest, changes *network.Changes, server *control.Server) error {
+	if guest.NetworkMode == api.NetworkModeMACVTAP {
+		return nil
+	}
+
+	ingress, err := network.ParseBandwidthLimits(c.GetStringSlice(cfgNetworkIngressLimit))
+	if err != nil {
+		return err
+	}
+
+	egress, err := network.ParseBandwidthLimits(c.GetStringSlice(cfgNetworkEgressLimit))
+	if err != nil {
+		return err
+	}
+
+	return network.AddBandwidthLimits(guest.NICs, ingress, egress, changes, server)
+}
+
+// startCapture captures the traffic of the selected NICs of the guest to pcap files,
+// the captures being started and stopped at runtime through the control API
+func startCapture(guest *api.Guest, server *control.Server) error {
+	if guest.NetworkMode == api.NetworkModeMACVTAP {
+		return nil
+	}
+
+	var maxSize uint64
+	if size := c.GetString(cfgCaptureMaxSize); size != "0" {
+		var err error
+		if maxSize, err = bytefmt.ToBytes(size); err != nil {
+			return fmt.Errorf("invalid capture size %q: %v", size, err)
+		}
+	}
+
+	if c.GetDuration(cfgCaptureMaxAge) < 0 || c.GetInt(cfgCaptureMaxFiles) < 0 {
+		return fmt.Errorf("--%s and --%s cannot be negative", cfgCaptureMaxAge, cfgCaptureMaxFiles)
+	}
+
+	filter, err := network.ParseBPFFilter(c.GetString(cfgCaptureFilter))
+	if err != nil {
+		return err
+	}
+
+	captureConfig := network.CaptureConfig{
+		Dir:      c.GetString(cfgCaptureDir),
+		MaxSize:  maxSize,
+		MaxAge:   c.GetDuration(cfgCaptureMaxAge),
+		MaxFiles: c.GetInt(cfgCaptureMaxFiles),
+		Filter:   filter,
+	}
+
+	return network.StartCapture(guest.NICs, c.GetStringSlice(cfgCaptureInterfaces), captureConfig, server)
+}
+
+const (
+	// the guest gets its network configuration over DHCP and DHCPv6
+	guestNetworkConfigDHCP = "dhcp"
+
+	// the guest gets its network configuration from Ignition
+	guestNetworkConfigStatic = "static"
+)
+
+// configureGuestNetwork hands the configuration of the network to the guest,
+// either over DHCP or through Ignition
+func configureGuestNetwork(guest *api.Guest, dhcpIfaces []network.DHCPInterface) error {
+	var static bool
+
+	switch config := c.GetString(cfgGuestNetworkConfig); config {
+	case guestNetworkConfigDHCP:
+	case guestNetworkConfigStatic:
+		static = true
+	default:
+		return fmt.Errorf("unknown guest network configuration %q", config)
+	}
+
+	dnsServers, err := network.DNSServers(c.GetStringSlice(cfgGuestDNSServers))
+	if err != nil {
+		return err
+	}
+
+	if c.GetBool(cfgDNSForwarder) {
+		if dnsServers, err = startDNSForwarder(guest, dhcpIfaces, dnsServers); err != nil {
+			return err
+		}
+	}
+
+	ntpServers := c.GetStringSlice(cfgGuestNTPServers)
+
+	searchDomains, err := network.DNSSearchDomains()
+	if err != nil {
+		log.Warningf("The guest gets no DNS search domains: %v", err)
+	}
+
+	var files []ignition.File
+
+	if static {
+		for i := range guest.NICs {
+			guest.NICs[i].StaticConfig = true
+		}
+
+		// the hostname is not served over DHCP either
+		files = append(files, ignition.File{
+			Path:     "/etc/hostname",
+			Mode:     0644,
+			Contents: guest.Name + "\n",
+		})
+	}
+
+	// the addresses which are not served over DHCP are configured by
+	// the network units of the guest, written by Ignition
+	files = append(files, network.NetworkdUnits(guest.NICs, dnsServers, ntpServers, searchDomains)...)
+
+	if len(files) > 0 {
+		ignitionPath, err := ignition.AddFiles(guest.OS.IgnitionConfig, files)
+		if err != nil {
+			return fmt.Errorf("an error occured during the generation of the guest network configuration: %v", err)
+		}
+
+		guest.OS.IgnitionConfig = ignitionPath
+	}
+
+	if static {
+		log.Infof("The guest network configuration is static, the DHCP servers are not started")
+		return nil
+	}
+
+	return startDHCPServers(guest, dhcpIfaces, dnsServers, ntpServers, searchDomains)
+}
+
+// startDNSForwarder starts the DNS forwarder on the gateway of the guest, which is an address of the
+// container in nat network mode only. The DNS servers of the guest are returned.
+func startDNSForwarder(guest *api.Guest, dhcpIfaces []network.DHCPInterface, dnsServers []string) ([]string, error) {
+	if guest.NetworkMode != api.NetworkModeNAT || len(dhcpIfaces) == 0 {
+		log.Warningf("The DNS forwarder is only supported in %s network mode, the gateway of the guest is not an address of the container otherwise",
+			api.NetworkModeNAT)
+
+		return dnsServers, nil
+	}
+
+	forwarder, err := network.NewDNSForwarder(dnsServers, c.GetStringSlice(cfgDNSHosts))
+	if err != nil {
+		return nil, err
+	}
+
+	// the guest resolves its own name
+	forwarder.AddHost(guest.Name, dhcpIfaces[0].VMIPNet.IP)
+
+	gateway := dhcpIfaces[0].GatewayIP.String()
+	if err := forwarder.Start(gateway); err != nil {
+		return nil, fmt.Errorf("an error occured during the start of the DNS forwarder: %v", err)
+	}
+
+	return []string{gateway}, nil
+}
+
+// startDHCPServers serves the network configuration to the guest over DHCP
+func startDHCPServers(guest *api.Guest, dhcpIfaces []network.DHCPInterface, dnsServers, ntpServers, searchDomains []string) error {
+	if leaseTime := c.GetDuration(cfgDHCPLeaseTime); leaseTime != 0 && (leaseTime < time.Minute || leaseTime >= math.MaxUint32*time.Second) {
+		return fmt.Errorf("invalid DHCP lease time %s", leaseTime)
+	}
+
+	dhcpOptions, err := network.ParseDHCPOptions(c.GetStringSlice(cfgDHCPOptions))
+	if err != nil {
+		return err
+	}
+
+	dhcpConfig := network.DHCPConfig{
+		LeaseTime:     c.GetDuration(cfgDHCPLeaseTime),
+		StateDir:      c.GetString(cfgStateDir),
+		SearchDomains: searchDomains,
+		Options:       dhcpOptions,
+	}
+
+	// Serve DHCP requests for those interfaces
+	// The function returns the available IP addresses that are being
+	// served over DHCP now
+	if err = network.StartDHCPServers(*guest, dhcpIfaces, dnsServers, ntpServers, dhcpConfig); err != nil {
+		return fmt.Errorf("an error occured during the start of the DHCP servers: %v", err)
+	}
+
+	return nil
+}
+
+// parsePublishFlag parses a port mapping given as "hostPort:guestPort[/protocol]"
+func parsePublishFlag(input string) (api.PortMapping, error) {
+	protocol := api.ProtocolTCP
+
+	if s := strings.SplitN(input, "/", 2); len(s) == 2 {
+		input = s[0]
+		protocol = api.Protocol(s[1])
+	}
+
+	switch protocol {
+	case api.ProtocolTCP, api.ProtocolUDP:
+	default:
+		return api.PortMapping{}, fmt.Errorf("unknown protocol %q", protocol)
+	}
+
+	s := strings.Split(input, ":")
+	if len(s) != 2 {
+		return api.PortMapping{}, fmt.Errorf("expected format is hostPort:guestPort[/protocol]")
+	}
+
+	hostPort, err := parsePort(s[0])
+	if err != nil {
+		return api.PortMapping{}, err
+	}
+
+	guestPort, err := parsePort(s[1])
+	if err != nil {
+		return api.PortMapping{}, err
+	}
+
+	return api.PortMapping{
+		HostPort:  hostPort,
+		GuestPort: guestPort,
+		Protocol:  protocol,
+	}, nil
+}
+
+func parsePort(input string) (int, error) {
+	port, err := strconv.Atoi(input)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", input)
+	}
+
+	return port, nil
+}
@@ -22,36 +22,86 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 
 	"github.com/giantswarm/containervmm/pkg/api"
+	"github.com/giantswarm/containervmm/pkg/backup"
+	"github.com/giantswarm/containervmm/pkg/control"
 	"github.com/giantswarm/containervmm/pkg/disk"
 	"github.com/giantswarm/containervmm/pkg/distro"
 	"github.com/giantswarm/containervmm/pkg/hypervisor"
-	"github.com/giantswarm/containervmm/pkg/network"
 )
 
 const (
-	cfgGuestName            = "guest-name"
-	cfgGuestMemory          = "guest-memory"
-	cfgGuestCPUs            = "guest-cpus"
-	cfgGuestRootDiskSize    = "guest-root-disk-size"
-	cfgGuestAdditionalDisks = "guest-additional-disks"
-	cfgGuestHostVolumes     = "guest-host-volumes"
-	cfgGuestDNSServers      = "guest-dns-servers"
-	cfgGuestNTPServers      = "guest-ntp-servers"
+	cfgGuestName               = "guest-name"
+	cfgGuestMemory             = "guest-memory"
+	cfgGuestCPUs               = "guest-cpus"
+	cfgGuestRootDiskSize       = "guest-root-disk-size"
+	cfgGuestAdditionalDisks    = "guest-additional-disks"
+	cfgGuestDiskBus            = "guest-disk-bus"
+	cfgGuestDiskCache          = "guest-disk-cache"
+	cfgGuestDiskAIO            = "guest-disk-aio"
+	cfgGuestDiskDiscard        = "guest-disk-discard"
+	cfgGuestDiskZeroes         = "guest-disk-detect-zeroes"
+	cfgGuestDiskIOThreads      = "guest-disk-iothreads"
+	cfgGuestDiskKeyFile        = "guest-disk-key-file"
+	cfgGuestDiskKeyEnv         = "guest-disk-key-env"
+	cfgGuestDiskWriteError     = "guest-disk-werror"
+	cfgGuestDiskReadError      = "guest-disk-rerror"
+	cfgGuestDiskErrorResume    = "guest-disk-error-resume-interval"
+	cfgGuestDiskOvercommit     = "guest-disk-overcommit-ratio"
+	cfgGuestDiskOvercommitFail = "guest-disk-overcommit-fail"
+	cfgGuestHostVolumes        = "guest-host-volumes"
+	cfgGuestDNSServers         = "guest-dns-servers"
+	cfgGuestNTPServers         = "guest-ntp-servers"
+	cfgGuestNetworkConfig      = "guest-network-config"
+
+	cfgNetworkMode              = "network-mode"
+	cfgNetworkAntiSpoofing      = "network-anti-spoofing"
+	cfgNetworkIngressLimit      = "network-ingress-limit"
+	cfgNetworkEgressLimit       = "network-egress-limit"
+	cfgNetworkPublish           = "network-publish"
+	cfgNetworkNATSubnet         = "network-nat-subnet"
+	cfgNetworkInclude           = "network-include"
+	cfgNetworkExclude           = "network-exclude"
+	cfgNetworkMultusNetworks    = "network-multus-networks"
+	cfgNetworkMultusAnnotations = "network-multus-annotations"
+
+	cfgDHCPLeaseTime = "dhcp-lease-time"
+	cfgDHCPOptions   = "dhcp-option"
+	cfgDNSForwarder  = "dns-forwarder"
+	cfgDNSHosts      = "dns-hosts"
+
+	cfgCaptureInterfaces = "capture-interfaces"
+	cfgCaptureDir        = "capture-dir"
+	cfgCaptureMaxSize    = "capture-max-size"
+	cfgCaptureMaxAge     = "capture-max-age"
+	cfgCaptureMaxFiles   = "capture-max-files"
+	cfgCaptureFilter     = "capture-filter"
 
 	cfgFlatcarChannel      = "flatcar-channel"
 	cfgFlatcarVersion      = "flatcar-version"
 	cfgFlatcarIgnition     = "flatcar-ignition"
 	cfgFlatcarIgnitionFile = "flatcar-ignition-file"
 
+	cfgBackupDir         = "backup-dir"
+	cfgBackupSchedule    = "backup-schedule"
+	cfgBackupDisks       = "backup-disks"
+	cfgBackupMode        = "backup-mode"
+	cfgBackupChainLength = "backup-chain-length"
+	cfgBackupRetention   = "backup-retention"
+
+	cfgControlSocket = "control-socket"
+
 	cfgDebug        = "debug"
 	cfgSanityChecks = "sanity-checks"
+	cfgStateDir     = "state-dir"
 
 	targetName = "containervmm"
 )
@@ -63,6 +113,21 @@ func configBoolVar(flags *pflag.FlagSet, key string, defaultValue bool, descript
 	_ = c.BindPFlag(key, flags.Lookup(key))
 }
 
+func configFloat64Var(flags *pflag.FlagSet, key string, defaultValue float64, description string) {
+	flags.Float64(key, defaultValue, description)
+	_ = c.BindPFlag(key, flags.Lookup(key))
+}
+
+func configIntVar(flags *pflag.FlagSet, key string, defaultValue int, description string) {
+	flags.Int(key, defaultValue, description)
+	_ = c.BindPFlag(key, flags.Lookup(key))
+}
+
+func configDurationVar(flags *pflag.FlagSet, key string, defaultValue time.Duration, description string) {
+	flags.Duration(key, defaultValue, description)
+	_ = c.BindPFlag(key, flags.Lookup(key))
+}
+
 func configStringVar(flags *pflag.FlagSet, key, defaultValue, description string) {
 	flags.String(key, defaultValue, description)
 	_ = c.BindPFlag(key, flags.Lookup(key))
@@ -85,6 +150,18 @@ var rootCmd = &cobra.Command{
 			Name:   c.GetString(cfgGuestName),
 			CPUs:   c.GetString(cfgGuestCPUs),
 			Memory: c.GetString(cfgGuestMemory),
+
+			DiskErrorResumeInterval: c.GetDuration(cfgGuestDiskErrorResume),
+		}
+
+		// the subsystems register their commands, status and metrics
+		// on the control API as they are set up
+		controlServer := control.NewServer()
+
+		if controlSocket := c.GetString(cfgControlSocket); controlSocket != "" {
+			if err := controlServer.Listen(controlSocket); err != nil {
+				return fmt.Errorf("an error occured during the start of the control API: %v", err)
+			}
 		}
 
 		kernel, initrd, err := distro.DownloadImages(c.GetString(cfgFlatcarChannel), c.GetString(cfgFlatcarVersion), c.GetBool(cfgSanityChecks))
@@ -116,37 +193,51 @@ var rootCmd = &cobra.Command{
 			guest.OS.IgnitionConfig = ignitionPath
 		}
 
-		// Setup networking inside of the container, return the available interfaces
-		dhcpIfaces, err := network.SetupInterfaces(&guest)
+		networkChanges, err := setupNetwork(&guest, controlServer)
 		if err != nil {
-			return fmt.Errorf("an error occured during the the setup of the network: %v", err)
+			return err
 		}
 
-		// Serve DHCP requests for those interfaces
-		// The function returns the available IP addresses that are being
-		// served over DHCP now
-		dnsServers := c.GetStringSlice(cfgGuestDNSServers)
-		ntpServers := c.GetStringSlice(cfgGuestNTPServers)
+		// restore the network of the container when the VM is gone or
+		// when it fails to start, so that the other containers sharing
+		// the network of the pod keep working
+		defer networkChanges.Revert()
 
-		if err = network.StartDHCPServers(guest, dhcpIfaces, dnsServers, ntpServers); err != nil {
-			return fmt.Errorf("an error occured during the start of the DHCP servers: %v", err)
+		// create rootfs and other additional volumes
+		rootDisk, err := defaultDisk()
+		if err != nil {
+			return fmt.Errorf("invalid disk options: %v", err)
 		}
 
-		// create rootfs and other additional volumes
-		guest.Disks = append(guest.Disks, api.Disk{
-			ID:     "rootfs",
-			Size:   c.GetString(cfgGuestRootDiskSize),
-			IsRoot: true,
-		})
+		rootDisk.ID = "rootfs"
+		rootDisk.Size = c.GetString(cfgGuestRootDiskSize)
+		rootDisk.IsRoot = true
+
+		guest.Disks = append(guest.Disks, rootDisk)
 
 		for _, gd := range c.GetStringSlice(cfgGuestAdditionalDisks) {
-			id, size := parseStringSliceFlag(gd)
+			additionalDisk, err := parseDiskFlag(gd)
+			if err != nil {
+				return fmt.Errorf("invalid additional disk %q: %v", gd, err)
+			}
 
-			guest.Disks = append(guest.Disks, api.Disk{
-				ID:     id,
-				Size:   size,
-				IsRoot: false,
-			})
+			guest.Disks = append(guest.Disks, additionalDisk)
+		}
+
+		ioThreads, err := parseIOThreadsFlag(c.GetString(cfgGuestDiskIOThreads), len(guest.Disks))
+		if err != nil {
+			return fmt.Errorf("invalid value for --%s: %v", cfgGuestDiskIOThreads, err)
+		}
+
+		guest.IOThreads = ioThreads
+
+		preflightConfig := disk.PreflightConfig{
+			OvercommitRatio:  c.GetFloat64(cfgGuestDiskOvercommit),
+			FailOnOvercommit: c.GetBool(cfgGuestDiskOvercommitFail),
+		}
+
+		if err := disk.Preflight(guest.Disks, preflightConfig); err != nil {
+			return err
 		}
 
 		if err := disk.CreateDisks(&guest); err != nil {
@@ -162,8 +253,24 @@ var rootCmd = &cobra.Command{
 			})
 		}
 
+		// schedule the backups of the disks, they run while QEMU is up
+		if backupDir := c.GetString(cfgBackupDir); backupDir != "" {
+			backupConfig := backup.Config{
+				Dir:         backupDir,
+				Schedule:    c.GetString(cfgBackupSchedule),
+				Disks:       c.GetStringSlice(cfgBackupDisks),
+				Mode:        backup.Mode(c.GetString(cfgBackupMode)),
+				ChainLength: c.GetInt(cfgBackupChainLength),
+				Retention:   c.GetInt(cfgBackupRetention),
+			}
+
+			if err := backup.Schedule(backupConfig, guest.Disks, controlServer); err != nil {
+				return fmt.Errorf("an error occured during the scheduling of backups: %v", err)
+			}
+		}
+
 		// execute QEMU
-		if err = hypervisor.ExecuteQEMU(guest); err != nil {
+		if err = hypervisor.ExecuteQEMU(guest, controlServer); err != nil {
 			return fmt.Errorf("an error occured during the execution of QEMU: %v", err)
 		}
 
@@ -185,18 +292,65 @@ func init() {
 	configStringVar(flags, cfgGuestCPUs, "1", "guest cpus")
 	configStringVar(flags, cfgGuestRootDiskSize, "20G", "guest root disk size")
 
-	configStringSlice(flags, cfgGuestAdditionalDisks, []string{}, "guest additional disk to mount (i.e. \"dockerfs:20GB\")")
+	configStringSlice(flags, cfgGuestAdditionalDisks, []string{}, "guest additional disk to mount, either a new disk of the given size or a block device of the container, optionally overriding the disk options (i.e. \"dockerfs:20GB\", \"data:/dev/xvda\", \"dockerfs:20GB:bus=virtio-scsi:cache=none:aio=native\", \"secrets:1GB:key-file=/etc/secrets/disk-key\")")
+	configStringVar(flags, cfgGuestDiskBus, string(api.BusVirtioBlk), "guest disk bus (i.e. virtio-blk, virtio-scsi). virtio-scsi hosts all the disks on a single controller")
+	configStringVar(flags, cfgGuestDiskCache, string(api.CacheWriteback), "guest disk cache mode (i.e. none, writeback, unsafe)")
+	configStringVar(flags, cfgGuestDiskAIO, string(api.AIOThreads), "guest disk AIO engine (i.e. threads, native, io_uring). native requires cache=none")
+	configStringVar(flags, cfgGuestDiskDiscard, string(api.DiscardUnmap), "guest disk discard mode (i.e. ignore, unmap). unmap releases the space freed by fstrim in the guest")
+	configStringVar(flags, cfgGuestDiskIOThreads, "0", "number of IOThreads handling the disk I/O, or \"per-disk\" for a dedicated IOThread per disk. If 0, the disk I/O is handled by the QEMU main loop")
+	configStringVar(flags, cfgGuestDiskKeyFile, "", "file holding the passphrase to encrypt the guest disks with LUKS. If left empty, the disks are not encrypted")
+	configStringVar(flags, cfgGuestDiskKeyEnv, "", "environment variable holding the passphrase to encrypt the guest disks with LUKS")
+	configStringVar(flags, cfgGuestDiskWriteError, string(api.ErrorENOSPC), "guest disk action on write errors (i.e. report, stop, enospc). enospc stops the VM only when the disk runs out of space")
+	configStringVar(flags, cfgGuestDiskReadError, string(api.ErrorReport), "guest disk action on read errors (i.e. report, stop)")
+	configDurationVar(flags, cfgGuestDiskErrorResume, 0, "interval between the attempts to resume the VM stopped by a disk error. If 0, the VM stays stopped")
+	configFloat64Var(flags, cfgGuestDiskOvercommit, 1, "maximum ratio between the size of the sparse guest disks and the free space of the filesystem. If 0, the ratio is not checked")
+	configBoolVar(flags, cfgGuestDiskOvercommitFail, false, "fail instead of warning when the guest disks exceed the overcommit ratio")
+	configStringVar(flags, cfgGuestDiskZeroes, string(api.DetectZeroesOff), "guest disk zero writes detection (i.e. off, on, unmap)")
 	configStringSlice(flags, cfgGuestHostVolumes, []string{}, "guest host volume (i.e. \"datashare:/usr/data\")")
 	configStringSlice(flags, cfgGuestDNSServers, []string{}, "guest DNS Servers. If left empty, the DNS servers given are the one of the container")
 	configStringSlice(flags, cfgGuestNTPServers, []string{}, "guest NTP Servers. If left empty, the NTP servers set are the default one from the distro")
+	configStringVar(flags, cfgGuestNetworkConfig, guestNetworkConfigDHCP, "guest network configuration (i.e. dhcp, static). static writes the network configuration of the guest with Ignition instead of serving it over DHCP")
+
+	configStringVar(flags, cfgNetworkMode, string(api.NetworkModeBridge), "network mode (i.e. bridge, macvtap, nat, user). With nat and user, the container keeps its addresses and the guest is behind NAT. user needs no privileges, the guest is behind the user mode network stack of QEMU")
+	configBoolVar(flags, cfgNetworkAntiSpoofing, false, "drop the frames of the guest whose source MAC or IP address is not the one of its interface, in bridge and nat network modes")
+	configStringSlice(flags, cfgNetworkIngressLimit, []string{}, "bandwidth limit of the traffic received by the guest as [interface=]rate[:burst], in bridge and nat network modes (i.e. \"100mbit\", \"eth1=1gbit:1M\")")
+	configStringSlice(flags, cfgNetworkEgressLimit, []string{}, "bandwidth limit of the traffic sent by the guest as [interface=]rate[:burst], in bridge and nat network modes (i.e. \"100mbit\", \"eth1=1gbit:1M\")")
+	configStringSlice(flags, cfgNetworkInclude, []string{}, "glob or /regular expression/ of the container interfaces handed to the guest. If left empty, all the interfaces are handed to the guest (i.e. \"eth*\", \"/^net[0-9]+$/\")")
+	configStringSlice(flags, cfgNetworkExclude, []string{}, "glob or /regular expression/ of the container interfaces left untouched in the container, taking precedence over the included ones")
+	configStringSlice(flags, cfgNetworkMultusNetworks, []string{}, "Multus networks whose interfaces are handed to the guest, along with the included ones (i.e. \"storage\", \"default/storage\")")
+	configStringVar(flags, cfgNetworkMultusAnnotations, "/etc/podinfo/annotations", "file holding the pod annotations exposed by the downward API, where Multus reports the interfaces of its networks")
+	configStringSlice(flags, cfgNetworkPublish, []string{}, "ports of the container forwarded to the guest in nat and user network modes (i.e. \"8080:80\", \"5353:53/udp\")")
+	configStringVar(flags, cfgNetworkNATSubnet, "192.168.122.0/24", "private IPv4 subnet of the guest in nat network mode, the container having the first address and the guest the second one")
+
+	configDurationVar(flags, cfgDHCPLeaseTime, 0, "lease time of the IPv4 addresses served over DHCP. The guest rebinds its lease at seven eighths of the lease time. If 0, the leases are infinite")
+	configBoolVar(flags, cfgDNSForwarder, false, "serve DNS to the guest on its gateway, forwarding the queries to the DNS servers of the container with caching. Only supported in nat network mode")
+	configStringSlice(flags, cfgDNSHosts, []string{}, "static host entries served by the DNS forwarder, along with the guest name (i.e. \"registry.local=10.0.0.10\")")
+	configStringSlice(flags, cfgDHCPOptions, []string{}, "extra DHCP option served to the guest as code:value, the value being bytes in hexadecimal prefixed by 0x, IPv4 addresses or a string (i.e. \"42:10.0.0.1,10.0.0.2\", \"43:0x0104c0a80001\")")
+
+	configStringSlice(flags, cfgCaptureInterfaces, []string{}, "interfaces of the container whose guest traffic is captured to pcap files, in bridge and nat network modes, nat being the interface of the guest in nat network mode (i.e. \"eth0\", \"nat\")")
+	configStringVar(flags, cfgCaptureDir, "captures", "directory to write the pcap files of the captured traffic to")
+	configStringVar(flags, cfgCaptureMaxSize, "100M", "size above which a new pcap file is started. If 0, the files are not rotated by size")
+	configDurationVar(flags, cfgCaptureMaxAge, time.Hour, "age above which a new pcap file is started. If 0, the files are not rotated by age")
+	configIntVar(flags, cfgCaptureMaxFiles, 10, "number of pcap files kept by interface, the oldest ones being removed. If 0, all the files are kept")
+	configStringVar(flags, cfgCaptureFilter, "", "BPF filter of the captured packets, as printed by tcpdump -ddd with the lines separated by commas (i.e. \"4,40 0 0 12,21 0 1 2054,6 0 0 262144,6 0 0 0\")")
 
 	configStringVar(flags, cfgFlatcarChannel, "stable", "flatcar channel (i.e. stable, beta, alpha)")
 	configStringVar(flags, cfgFlatcarVersion, "", "flatcar version")
 	configStringVar(flags, cfgFlatcarIgnition, "", "optional content of base64-encoded ignition")
 	configStringVar(flags, cfgFlatcarIgnitionFile, "", "optional path to file containing ignition json")
 
+	configStringVar(flags, cfgBackupDir, "", "directory to write disk backups to. If left empty, backups are disabled")
+	configStringVar(flags, cfgBackupSchedule, "@midnight", "cron schedule of the disk backups (i.e. \"0 2 * * *\"). If left empty, the backups only run when requested through the control API")
+	configStringSlice(flags, cfgBackupDisks, []string{}, "IDs of the disks to backup. If left empty, all the disks are backed up")
+	configStringVar(flags, cfgBackupMode, "full", "disk backup mode (i.e. full, incremental)")
+	configIntVar(flags, cfgBackupChainLength, 7, "number of backups of a chain in incremental mode, the full backup included, before a new chain is started with a full backup")
+	configIntVar(flags, cfgBackupRetention, 7, "number of backup chains to keep, a full backup along with its incremental backups")
+
+	configStringVar(flags, cfgControlSocket, "control.sock", "UNIX socket serving the control API. If left empty, the control API is disabled")
+
 	configBoolVar(flags, cfgSanityChecks, true, "run sanity checks (GPG verification of images)")
 	configBoolVar(flags, cfgDebug, false, "enable debug")
+	configStringVar(flags, cfgStateDir, ".", "directory holding the state kept across the restarts of containervmm, such as the DHCP leases")
 }
 
 func initConfig() {
@@ -207,6 +361,111 @@ func initConfig() {
 	c.AutomaticEnv() // read in environment variables that match
 }
 
+// defaultDisk returns a disk with the options given by the flags
+func defaultDisk() (api.Disk, error) {
+	gd := api.Disk{
+		Bus:          api.DiskBus(c.GetString(cfgGuestDiskBus)),
+		Cache:        api.CacheMode(c.GetString(cfgGuestDiskCache)),
+		AIO:          api.AIOEngine(c.GetString(cfgGuestDiskAIO)),
+		Discard:      api.DiscardMode(c.GetString(cfgGuestDiskDiscard)),
+		DetectZeroes: api.DetectZeroes(c.GetString(cfgGuestDiskZeroes)),
+		KeyFile:      c.GetString(cfgGuestDiskKeyFile),
+
+		WriteErrorPolicy: api.ErrorPolicy(c.GetString(cfgGuestDiskWriteError)),
+		ReadErrorPolicy:  api.ErrorPolicy(c.GetString(cfgGuestDiskReadError)),
+	}
+
+	if keyEnv := c.GetString(cfgGuestDiskKeyEnv); keyEnv != "" {
+		keyFile, err := disk.KeyFileFromEnv(keyEnv)
+		if err != nil {
+			return api.Disk{}, err
+		}
+
+		gd.KeyFile = keyFile
+	}
+
+	return gd, nil
+}
+
+// parseDiskFlag parses a disk given as "id:size[:option=value...]", or as
+// "id:/dev/path[:option=value...]" for a block device of the container
+func parseDiskFlag(input string) (api.Disk, error) {
+	s := strings.Split(input, ":")
+	if len(s) < 2 {
+		return api.Disk{}, fmt.Errorf("expected format is id:size[:option=value...]")
+	}
+
+	gd, err := defaultDisk()
+	if err != nil {
+		return api.Disk{}, err
+	}
+
+	gd.ID = s[0]
+
+	if strings.HasPrefix(s[1], "/") {
+		gd.File = s[1]
+		gd.BlockDevice = true
+	} else {
+		gd.Size = s[1]
+	}
+
+	for _, option := range s[2:] {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			return api.Disk{}, fmt.Errorf("option %q is not in the form option=value", option)
+		}
+
+		switch kv[0] {
+		case "bus":
+			gd.Bus = api.DiskBus(kv[1])
+		case "cache":
+			gd.Cache = api.CacheMode(kv[1])
+		case "aio":
+			gd.AIO = api.AIOEngine(kv[1])
+		case "discard":
+			gd.Discard = api.DiscardMode(kv[1])
+		case "detect-zeroes":
+			gd.DetectZeroes = api.DetectZeroes(kv[1])
+		case "werror":
+			gd.WriteErrorPolicy = api.ErrorPolicy(kv[1])
+		case "rerror":
+			gd.ReadErrorPolicy = api.ErrorPolicy(kv[1])
+		case "key-file":
+			gd.KeyFile = kv[1]
+		case "key-env":
+			keyFile, err := disk.KeyFileFromEnv(kv[1])
+			if err != nil {
+				return api.Disk{}, err
+			}
+
+			gd.KeyFile = keyFile
+		default:
+			return api.Disk{}, fmt.Errorf("unknown option %q", kv[0])
+		}
+	}
+
+	return gd, nil
+}
+
+// parseIOThreadsFlag returns the number of IOThreads given either as a
+// number or as "per-disk"
+func parseIOThreadsFlag(input string, disks int) (int, error) {
+	if input == "per-disk" {
+		return disks, nil
+	}
+
+	ioThreads, err := strconv.Atoi(input)
+	if err != nil {
+		return 0, fmt.Errorf("expected a number or \"per-disk\", got %q", input)
+	}
+
+	if ioThreads < 0 {
+		return 0, fmt.Errorf("the number of IOThreads cannot be negative")
+	}
+
+	return ioThreads, nil
+}
+
 func parseStringSliceFlag(input string) (string, string) {
 	s := strings.Split(input, ":")
 
@@ -2,6 +2,8 @@ package api
 
 import (
 	"net"
+	"os"
+	"time"
 
 	"github.com/vishvananda/netlink"
 )
@@ -17,9 +19,27 @@ type Guest struct {
 	Disks       []Disk
 	HostVolumes []HostVolume
 
+	// DiskErrorResumeInterval is the interval between the attempts to
+	// resume the VM once it is stopped by a disk I/O error. If zero, the
+	// VM stays stopped.
+	DiskErrorResumeInterval time.Duration
+
+	// IOThreads is the number of dedicated IOThreads handling the I/O of
+	// the disks, which are bound to them in a round robin fashion.
+	// If zero, the I/O is handled by the main loop of QEMU.
+	IOThreads int
+
 	// Guest OS
 	OS OS
 
+	// NetworkMode is the way the guest is connected to the network of
+	// the container
+	NetworkMode NetworkMode
+
+	// PortMappings are the ports of the container forwarded to the guest
+	// in user network mode
+	PortMappings []PortMapping
+
 	// DHCP Interfaces
 	NICs []NetworkInterface
 }
@@ -35,10 +55,69 @@ type OS struct {
 // NetworkInterface describe the network interface of the guest
 type NetworkInterface struct {
 	GatewayIP   *net.IP
-	InterfaceIP *net.IP
-	Routes      []netlink.Route
-	MacAddr     string
-	TAP         string
+	GatewayIPv6 *net.IP
+
+	// Addresses holds the IPv4 and then the IPv6 addresses of the
+	// interface. The first address of each family is the primary one.
+	Addresses []net.IPNet
+
+	Routes  []netlink.Route
+	MacAddr string
+	TAP     string
+
+	// FDs are the open file descriptors of the TAP device, handed to
+	// QEMU in place of the name of the device. A TAP device has one per
+	// queue.
+	FDs []*os.File
+
+	// VhostFDs are the open vhost-net devices handling the datapath of
+	// the queues in the kernel. If empty, the datapath is in QEMU.
+	VhostFDs []*os.File
+
+	// MTU is the MTU of the container interface, given to the guest by
+	// the virtio-net device
+	MTU int
+
+	// StaticConfig is true when the guest cannot be reached over DHCP and
+	// its network configuration is static
+	StaticConfig bool
+}
+
+// NetworkMode is the way the guest is connected to the network of the container
+type NetworkMode string
+
+const (
+	// the interfaces of the container are bridged to the guest, which
+	// takes over their addresses
+	NetworkModeBridge NetworkMode = "bridge"
+
+	// the guest is behind the user mode network stack of QEMU, which
+	// needs no privileges
+	NetworkModeUser NetworkMode = "user"
+
+	// the guest is connected to the interfaces of the container through
+	// macvtap devices in passthru mode, it takes over their addresses
+	// and MAC addresses
+	NetworkModeMACVTAP NetworkMode = "macvtap"
+
+	// the guest is on a private subnet behind a bridge of the container,
+	// which keeps its addresses and masquerades the traffic of the guest
+	NetworkModeNAT NetworkMode = "nat"
+)
+
+// Protocol is the transport protocol of a port mapping
+type Protocol string
+
+const (
+	ProtocolTCP Protocol = "tcp"
+	ProtocolUDP Protocol = "udp"
+)
+
+// PortMapping forwards a port of the container to a port of the guest
+type PortMapping struct {
+	HostPort  int
+	GuestPort int
+	Protocol  Protocol
 }
 
 type FsType string
@@ -49,6 +128,66 @@ const (
 	EXT4 FsType = "ext4"
 )
 
+// CacheMode is the host page cache mode of a disk
+type CacheMode string
+
+const (
+	CacheNone      CacheMode = "none"
+	CacheWriteback CacheMode = "writeback"
+	CacheUnsafe    CacheMode = "unsafe"
+)
+
+// AIOEngine is the engine used by QEMU for the disk I/O
+type AIOEngine string
+
+const (
+	AIOThreads AIOEngine = "threads"
+	AIONative  AIOEngine = "native"
+	AIOIOUring AIOEngine = "io_uring"
+)
+
+// DiscardMode defines whether the discard requests of the guest are
+// passed to the disk file, releasing the space of sparse files
+type DiscardMode string
+
+const (
+	DiscardIgnore DiscardMode = "ignore"
+	DiscardUnmap  DiscardMode = "unmap"
+)
+
+// DetectZeroes defines whether writes of zeroes are detected and
+// converted into zero writes or, with DetectZeroesUnmap, into discards
+type DetectZeroes string
+
+const (
+	DetectZeroesOff   DetectZeroes = "off"
+	DetectZeroesOn    DetectZeroes = "on"
+	DetectZeroesUnmap DetectZeroes = "unmap"
+)
+
+// DiskBus is the bus the disk is attached to
+type DiskBus string
+
+const (
+	// BusVirtioBlk attaches the disk as a virtio-blk PCI device
+	BusVirtioBlk DiskBus = "virtio-blk"
+	// BusVirtioSCSI attaches the disk as a LUN of a virtio-scsi controller
+	BusVirtioSCSI DiskBus = "virtio-scsi"
+)
+
+// ErrorPolicy is the action taken on a disk I/O error
+type ErrorPolicy string
+
+const (
+	// ErrorReport reports the error to the guest
+	ErrorReport ErrorPolicy = "report"
+	// ErrorStop stops the VM until it is resumed
+	ErrorStop ErrorPolicy = "stop"
+	// ErrorENOSPC stops the VM when the disk runs out of space and reports
+	// the other errors to the guest. It is only valid for write errors.
+	ErrorENOSPC ErrorPolicy = "enospc"
+)
+
 type Disk struct {
 	ID string
 
@@ -56,7 +195,25 @@ type Disk struct {
 	File   string
 	IsRoot bool
 
+	// BlockDevice is true when File is an existing block device of the
+	// container, i.e. a raw block volume, which is attached as it is
+	BlockDevice bool
+
+	// KeyFile is the file holding the passphrase of a LUKS encrypted disk.
+	// If empty, the disk is not encrypted.
+	KeyFile string
+
 	Filesystem FsType
+
+	Bus DiskBus
+
+	Cache        CacheMode
+	AIO          AIOEngine
+	Discard      DiscardMode
+	DetectZeroes DetectZeroes
+
+	WriteErrorPolicy ErrorPolicy
+	ReadErrorPolicy  ErrorPolicy
 }
 
 // HostVolume is a shared volume between the host and the VM,
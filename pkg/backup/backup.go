@@ -0,0 +1,674 @@
+/*
+
+Copyright 2020 Salvatore Mazzarino
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/giantswarm/containervmm/pkg/api"
+	"github.com/giantswarm/containervmm/pkg/control"
+	"github.com/giantswarm/containervmm/pkg/hypervisor"
+	"github.com/giantswarm/containervmm/pkg/qmp"
+)
+
+type Mode string
+
+const (
+	// Full copies the whole content of the disks at every run
+	Full Mode = "full"
+	// Incremental copies only the blocks changed since the previous
+	// backup, tracked by a dirty bitmap. The first run of each chain is
+	// full.
+	Incremental Mode = "incremental"
+
+	// name of the dirty bitmap tracking the changes between two backups
+	bitmapName = "containervmm-backup"
+
+	// timeout of the single QMP and guest agent commands
+	commandTimeout = 30 * time.Second
+
+	// how often the progress of the running jobs is reported
+	progressInterval = 10 * time.Second
+
+	// prefix of the IDs of the backup jobs, followed by the disk ID
+	jobPrefix = "backup-"
+
+	// sortable timestamp prefixing the backup files
+	timestampFormat = "20060102T150405.000000Z"
+)
+
+// Config describes when and how the disks of the guest are backed up
+type Config struct {
+	// Dir is the directory the backups are written to
+	Dir string
+
+	// Schedule is a cron expression (i.e. "0 2 * * *" or "@daily"). If
+	// empty, the backups only run when requested through the control API.
+	Schedule string
+
+	// Disks is the list of disk IDs to backup, all of them if empty
+	Disks []string
+
+	Mode Mode
+
+	// ChainLength is the number of backups of a chain in incremental
+	// mode, the full backup included. A new chain is started with a full
+	// backup once it is reached.
+	ChainLength int
+
+	// Retention is the number of chains, a full backup along with its
+	// incremental backups, kept for each disk
+	Retention int
+}
+
+// Status is the state of the backups exposed by the control API
+type Status struct {
+	Running bool `json:"running"`
+
+	// LastRun is the start of the last backup, nil if none ran yet
+	LastRun *time.Time `json:"lastRun,omitempty"`
+
+	// LastError is the error of the last backup, empty if it succeeded
+	LastError string `json:"lastError,omitempty"`
+
+	// Last is the last backup file written for each disk
+	Last map[string]string `json:"last"`
+}
+
+// jobInfo is the state of a job returned by query-jobs
+type jobInfo struct {
+	ID              string `json:"id"`
+	Status          string `json:"status"`
+	CurrentProgress int64  `json:"current-progress"`
+	TotalProgress   int64  `json:"total-progress"`
+	Error           string `json:"error"`
+}
+
+type job struct {
+	id     string
+	disk   string
+	target string
+	full   bool
+
+	// last progress logged, in percent
+	progress int64
+}
+
+type backuper struct {
+	Config
+
+	disks []api.Disk
+
+	// prevent two runs to overlap when a backup takes longer than the
+	// interval of the schedule, and protects the status
+	lock    sync.Mutex
+	running bool
+	lastRun *time.Time
+	lastErr error
+
+	// disks on which the dirty bitmap has been created
+	bitmaps map[string]bool
+
+	// last backup file written for each disk, the base of the next
+	// incremental backup
+	last map[string]string
+
+	// number of backups of the current chain of each disk
+	chains map[string]int
+}
+
+// Schedule validates the configuration and starts the periodic backups of
+// the guest disks. The backups can also be requested with the backup
+// command of the control API, optionally forcing a full backup.
+func Schedule(cfg Config, guestDisks []api.Disk, server *control.Server) error {
+	b := &backuper{
+		Config:  cfg,
+		bitmaps: map[string]bool{},
+		last:    map[string]string{},
+		chains:  map[string]int{},
+	}
+
+	switch b.Mode {
+	case Full, Incremental:
+	default:
+		return fmt.Errorf("unknown backup mode %q", b.Mode)
+	}
+
+	if b.ChainLength < 1 {
+		return fmt.Errorf("backup chain length must be at least 1, got %d", b.ChainLength)
+	}
+
+	if b.Retention < 1 {
+		return fmt.Errorf("backup retention must be at least 1, got %d", b.Retention)
+	}
+
+	if len(b.Disks) == 0 {
+		b.disks = guestDisks
+	}
+
+	for _, id := range b.Disks {
+		found := false
+
+		for _, gd := range guestDisks {
+			if gd.ID == id {
+				b.disks = append(b.disks, gd)
+				found = true
+
+				break
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("disk %q selected for backup does not exist", id)
+		}
+	}
+
+	if err := os.MkdirAll(b.Dir, 0755); err != nil {
+		return fmt.Errorf("failed to create backup directory %s: %v", b.Dir, err)
+	}
+
+	server.HandleCommand("/backup", b.handleBackup)
+	server.AddStatus("backup", b.status)
+
+	if b.Schedule == "" {
+		log.Infof("Backups of %d disks to %s run on request only", len(b.disks), b.Dir)
+		return nil
+	}
+
+	scheduler := cron.New()
+	if _, err := scheduler.AddFunc(b.Schedule, b.scheduled); err != nil {
+		return fmt.Errorf("invalid backup schedule %q: %v", b.Schedule, err)
+	}
+
+	scheduler.Start()
+
+	log.Infof("Scheduled %s backups of %d disks to %s (%s)", b.Mode, len(b.disks), b.Dir, b.Schedule)
+
+	return nil
+}
+
+func (b *backuper) scheduled() {
+	if err := b.start(false); err != nil {
+		log.Warningf("Skipping the scheduled backup: %v", err)
+	}
+}
+
+// handleBackup starts a backup requested through the control API. The
+// query parameter full=true starts a new chain with a full backup.
+func (b *backuper) handleBackup(r *http.Request) (interface{}, error) {
+	var full bool
+
+	if value := r.URL.Query().Get("full"); value != "" {
+		var err error
+		if full, err = strconv.ParseBool(value); err != nil {
+			return nil, control.BadRequest(fmt.Errorf("invalid value %q of full", value))
+		}
+	}
+
+	if err := b.start(full); err != nil {
+		return nil, err
+	}
+
+	return b.status(), nil
+}
+
+// start runs a backup in the background, unless a backup or one of its jobs
+// is still running
+func (b *backuper) start(full bool) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.running {
+		return control.BadRequest(fmt.Errorf("a backup is already running"))
+	}
+
+	if err := checkJobs(); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+
+	b.running = true
+	b.lastRun = &now
+	b.lastErr = nil
+
+	go func() {
+		err := b.backup(full)
+		if err != nil {
+			log.Errorf("Backup failed: %v", err)
+		}
+
+		b.lock.Lock()
+		b.running = false
+		b.lastErr = err
+		b.lock.Unlock()
+	}()
+
+	return nil
+}
+
+// checkJobs returns an error if a backup job is still running in QEMU, such
+// as the jobs left behind when a backup gives up waiting for them. The
+// concluded jobs left behind are dismissed, their IDs being reused by the
+// next backup.
+func checkJobs() error {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	q, err := qmp.Dial(ctx, hypervisor.QMPControlSocket)
+	if err != nil {
+		return fmt.Errorf("failed to connect to QMP: %v", err)
+	}
+	defer q.Close()
+
+	var infos []jobInfo
+	if err := q.Execute(ctx, "query-jobs", nil, &infos); err != nil {
+		return fmt.Errorf("failed to query backup jobs: %v", err)
+	}
+
+	var running []string
+
+	for _, info := range infos {
+		if !strings.HasPrefix(info.ID, jobPrefix) {
+			continue
+		}
+
+		if info.Status != "concluded" {
+			running = append(running, info.ID)
+			continue
+		}
+
+		if err := q.Execute(ctx, "job-dismiss", map[string]interface{}{"id": info.ID}, nil); err != nil {
+			return fmt.Errorf("failed to dismiss job %s: %v", info.ID, err)
+		}
+	}
+
+	if len(running) > 0 {
+		return control.BadRequest(fmt.Errorf("backup jobs %s are still running", strings.Join(running, ", ")))
+	}
+
+	return nil
+}
+
+func (b *backuper) status() interface{} {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	status := Status{
+		Running: b.running,
+		LastRun: b.lastRun,
+		Last:    map[string]string{},
+	}
+
+	if b.lastErr != nil {
+		status.LastError = b.lastErr.Error()
+	}
+
+	for disk, file := range b.last {
+		status.Last[disk] = file
+	}
+
+	return status
+}
+
+// backup backs up the disks, starting a new chain when full is set. Only
+// one backup runs at a time, so the state of the chains is only accessed
+// by the running backup, but for the status.
+func (b *backuper) backup(full bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	q, err := qmp.Dial(ctx, hypervisor.QMPControlSocket)
+	cancel()
+
+	if err != nil {
+		return fmt.Errorf("failed to connect to QMP: %v", err)
+	}
+	defer q.Close()
+
+	// the timestamp has a sub-second precision so that a requested backup
+	// and a scheduled one started in the same second get their own files
+	timestamp := time.Now().UTC().Format(timestampFormat)
+
+	var actions []map[string]interface{}
+	var jobs []*job
+
+	for _, gd := range b.disks {
+		dir := filepath.Join(b.Dir, gd.ID)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create backup directory %s: %v", dir, err)
+		}
+
+		j := &job{
+			id:   jobPrefix + gd.ID,
+			disk: gd.ID,
+		}
+
+		// The data is copied as it is stored in the disk file, so the
+		// backups of encrypted disks are encrypted as well
+		node := hypervisor.FileNodeName(gd.ID)
+
+		args := map[string]interface{}{
+			"job-id":       j.id,
+			"device":       node,
+			"format":       "qcow2",
+			"auto-dismiss": false,
+		}
+
+		// incremental backups need a full backup as base, which is missing
+		// after a start of the VM as the bitmaps are not persisted. A new
+		// chain is started once the current one is complete, so that the
+		// retention can remove the oldest chains.
+		b.lock.Lock()
+		base, incremental := b.last[gd.ID]
+		b.lock.Unlock()
+
+		if b.Mode == Full || full || b.chains[gd.ID] >= b.ChainLength {
+			incremental = false
+		}
+
+		if incremental {
+			if j.target, err = newTarget(dir, timestamp, "incremental"); err != nil {
+				return err
+			}
+
+			// chain the incremental backup to the previous one
+			if err := createOverlay(j.target, base); err != nil {
+				return fmt.Errorf("failed to create backup file for disk %s: %v", gd.ID, err)
+			}
+
+			args["sync"] = "incremental"
+			args["bitmap"] = bitmapName
+			args["mode"] = "existing"
+		} else {
+			if j.target, err = newTarget(dir, timestamp, "full"); err != nil {
+				return err
+			}
+
+			args["sync"] = "full"
+			args["mode"] = "absolute-paths"
+
+			j.full = true
+		}
+
+		if b.Mode == Incremental && !incremental {
+			// (re)start tracking the changes from this point in time
+			bitmapAction := "block-dirty-bitmap-add"
+			if b.bitmaps[gd.ID] {
+				bitmapAction = "block-dirty-bitmap-clear"
+			}
+
+			actions = append(actions, map[string]interface{}{
+				"type": bitmapAction,
+				"data": map[string]interface{}{"node": node, "name": bitmapName},
+			})
+		}
+
+		args["target"] = j.target
+
+		actions = append(actions, map[string]interface{}{
+			"type": "drive-backup",
+			"data": args,
+		})
+
+		jobs = append(jobs, j)
+	}
+
+	// The backup jobs are started in a single transaction, so the copies
+	// of all the disks refer to the same point in time. The guest
+	// filesystems only need to be frozen until the jobs are started.
+	thaw := freezeGuest()
+
+	ctx, cancel = context.WithTimeout(context.Background(), commandTimeout)
+	err = q.Execute(ctx, "transaction", map[string]interface{}{"actions": actions}, nil)
+	cancel()
+
+	thaw()
+
+	if err != nil {
+		for _, j := range jobs {
+			_ = os.Remove(j.target)
+		}
+
+		return fmt.Errorf("failed to start backup jobs: %v", err)
+	}
+
+	if b.Mode == Incremental {
+		for _, gd := range b.disks {
+			b.bitmaps[gd.ID] = true
+		}
+	}
+
+	log.Infof("Started backup of %d disks", len(jobs))
+
+	succeeded, err := waitJobs(q, jobs)
+
+	done := map[string]bool{}
+
+	for _, j := range succeeded {
+		b.lock.Lock()
+		b.last[j.disk] = j.target
+		b.lock.Unlock()
+
+		if j.full {
+			b.chains[j.disk] = 0
+		}
+
+		b.chains[j.disk]++
+		done[j.disk] = true
+
+		if err := prune(filepath.Dir(j.target), b.Retention); err != nil {
+			log.Warningf("Failed to apply retention to backups of disk %s: %v", j.disk, err)
+		}
+	}
+
+	// the changes tracked since the previous backup are lost when a job
+	// fails, so the next backup of the disk starts a new chain
+	for _, j := range jobs {
+		if !done[j.disk] {
+			b.chains[j.disk] = b.ChainLength
+		}
+	}
+
+	return err
+}
+
+// newTarget returns the path of a new backup file, which must not exist as
+// the backup jobs overwrite their target
+func newTarget(dir, timestamp, kind string) (string, error) {
+	target := filepath.Join(dir, fmt.Sprintf("%s-%s.qcow2", timestamp, kind))
+
+	if _, err := os.Stat(target); err == nil {
+		return "", fmt.Errorf("backup file %s exists already", target)
+	} else if !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to check backup file %s: %v", target, err)
+	}
+
+	return target, nil
+}
+
+// waitJobs reports the progress of the backup jobs until they conclude
+// and returns the ones which succeeded
+func waitJobs(q *qmp.Client, jobs []*job) ([]*job, error) {
+	pending := map[string]*job{}
+	for _, j := range jobs {
+		pending[j.id] = j
+	}
+
+	var succeeded []*job
+	var failed []string
+
+	for len(pending) > 0 {
+		time.Sleep(progressInterval)
+
+		var infos []jobInfo
+
+		ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+		err := q.Execute(ctx, "query-jobs", nil, &infos)
+		cancel()
+
+		if err != nil {
+			return succeeded, fmt.Errorf("failed to query backup jobs: %v", err)
+		}
+
+		for _, info := range infos {
+			j, ok := pending[info.ID]
+			if !ok {
+				continue
+			}
+
+			if info.TotalProgress > 0 {
+				progress := info.CurrentProgress * 100 / info.TotalProgress
+				if progress != j.progress {
+					log.Infof("Backup of disk %s: %d%%", j.disk, progress)
+					j.progress = progress
+				}
+			}
+
+			if info.Status != "concluded" {
+				continue
+			}
+
+			if info.Error != "" {
+				log.Errorf("Backup of disk %s failed: %s", j.disk, info.Error)
+				failed = append(failed, j.disk)
+
+				// do not leave a partial backup around
+				_ = os.Remove(j.target)
+			} else {
+				log.Infof("Backup of disk %s written to %s", j.disk, j.target)
+				succeeded = append(succeeded, j)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+			err := q.Execute(ctx, "job-dismiss", map[string]interface{}{"id": info.ID}, nil)
+			cancel()
+
+			if err != nil {
+				log.Warningf("Failed to dismiss job %s: %v", info.ID, err)
+			}
+
+			delete(pending, info.ID)
+		}
+	}
+
+	if len(failed) > 0 {
+		return succeeded, fmt.Errorf("backup of disks %s failed", strings.Join(failed, ", "))
+	}
+
+	return succeeded, nil
+}
+
+// freezeGuest freezes the guest filesystems when the guest agent is running
+// in the guest and returns the function to thaw them
+func freezeGuest() func() {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	ga, err := qmp.DialGuestAgent(ctx, hypervisor.GuestAgentSocket)
+	if err != nil {
+		log.Warningf("Guest agent not available, backing up without freezing the filesystems: %v", err)
+		return func() {}
+	}
+
+	var frozen int
+	if err := ga.Execute(ctx, "guest-fsfreeze-freeze", nil, &frozen); err != nil {
+		log.Warningf("Failed to freeze guest filesystems: %v", err)
+		ga.Close()
+
+		return func() {}
+	}
+
+	log.Infof("Froze %d guest filesystems", frozen)
+
+	return func() {
+		defer ga.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+		defer cancel()
+
+		var thawed int
+		if err := ga.Execute(ctx, "guest-fsfreeze-thaw", nil, &thawed); err != nil {
+			log.Errorf("Failed to thaw guest filesystems: %v", err)
+			return
+		}
+
+		log.Infof("Thawed %d guest filesystems", thawed)
+	}
+}
+
+// createOverlay creates a qcow2 image backed by the given one, which is
+// the target of an incremental backup
+func createOverlay(filename, backingFile string) error {
+	cmd := exec.Command("qemu-img", "create", "-f", "qcow2", "-F", "qcow2", "-b", backingFile, filename)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v: %s", err, stderr.String())
+	}
+
+	return nil
+}
+
+// prune removes the oldest backup chains of a disk, keeping the newest
+// retention full backups and the incremental backups based on them. A
+// chain is only removed as a whole, along with its full backup.
+func prune(dir string, retention int) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.qcow2"))
+	if err != nil {
+		return err
+	}
+
+	// backup files are prefixed with a sortable timestamp
+	sort.Strings(files)
+
+	var fulls []int
+	for i, f := range files {
+		if strings.HasSuffix(f, "-full.qcow2") {
+			fulls = append(fulls, i)
+		}
+	}
+
+	if len(fulls) <= retention {
+		return nil
+	}
+
+	for _, f := range files[:fulls[len(fulls)-retention]] {
+		log.Infof("Removing expired backup %s", f)
+
+		if err := os.Remove(f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,217 @@
+/*
+
+Copyright 2020 Salvatore Mazzarino
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Server serves the control API of containervmm over HTTP on a UNIX socket. The subsystems register the
+// commands they handle, their sections of the status, served as JSON on /status, and their metrics,
+// served in the Prometheus text format on /metrics.
+type Server struct {
+	mux *http.ServeMux
+
+	lock    sync.Mutex
+	status  map[string]func() interface{}
+	metrics []func() []Metric
+}
+
+// Metric is a metric exposed on /metrics
+type Metric struct {
+	Name string
+	Help string
+
+	// Type is the Prometheus type of the metric (i.e. gauge, counter)
+	Type string
+
+	Samples []Sample
+}
+
+// Sample is a value of a metric with a set of labels
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// badRequest is an error caused by an invalid command
+type badRequest struct {
+	error
+}
+
+// BadRequest marks the error returned by a command handler as caused by an invalid command
+func BadRequest(err error) error {
+	return badRequest{err}
+}
+
+// NewServer returns a server without commands, status or metrics
+func NewServer() *Server {
+	s := &Server{
+		mux:    http.NewServeMux(),
+		status: map[string]func() interface{}{},
+	}
+
+	s.mux.HandleFunc("/status", s.serveStatus)
+	s.mux.HandleFunc("/metrics", s.serveMetrics)
+
+	return s
+}
+
+// HandleCommand registers the handler of the command sent with a POST request to the given path. The
+// value returned by the handler is sent back as JSON.
+func (s *Server) HandleCommand(path string, handler func(r *http.Request) (interface{}, error)) {
+	s.mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			replyError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s expects a POST request", path))
+
+			return
+		}
+
+		result, err := handler(r)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if _, ok := err.(badRequest); ok {
+				status = http.StatusBadRequest
+			}
+
+			log.Errorf("Control command %s failed: %v", path, err)
+			replyError(w, status, err)
+
+			return
+		}
+
+		reply(w, http.StatusOK, result)
+	})
+}
+
+// AddStatus registers a section of the status, returned by the given function
+func (s *Server) AddStatus(name string, status func() interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.status[name] = status
+}
+
+// AddMetrics registers a function returning metrics
+func (s *Server) AddMetrics(metrics func() []Metric) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.metrics = append(s.metrics, metrics)
+}
+
+// Listen serves the control API on the given UNIX socket, replacing the socket left by a previous run
+func (s *Server) Listen(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale control socket: %v", err)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to listen on control socket: %v", err)
+	}
+
+	// the socket gives control over the VM
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to restrict access to control socket: %v", err)
+	}
+
+	go func() {
+		if err := http.Serve(listener, s.mux); err != nil {
+			log.Errorf("Control API stopped: %v", err)
+		}
+	}()
+
+	log.Infof("Serving the control API on %s", path)
+
+	return nil
+}
+
+func (s *Server) serveStatus(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	status := map[string]interface{}{}
+	for name, f := range s.status {
+		status[name] = f()
+	}
+
+	reply(w, http.StatusOK, status)
+}
+
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	for _, f := range s.metrics {
+		for _, m := range f() {
+			writeMetric(w, m)
+		}
+	}
+}
+
+// writeMetric writes a metric in the Prometheus text format
+func writeMetric(w io.Writer, m Metric) {
+	fmt.Fprintf(w, "# HELP %s %s\n", m.Name, m.Help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.Name, m.Type)
+
+	for _, sample := range m.Samples {
+		var labels []string
+		for name, value := range sample.Labels {
+			labels = append(labels, fmt.Sprintf("%s=%s", name, strconv.Quote(value)))
+		}
+
+		// the labels are sorted to keep the output stable
+		sort.Strings(labels)
+
+		name := m.Name
+		if len(labels) > 0 {
+			name += "{" + strings.Join(labels, ",") + "}"
+		}
+
+		fmt.Fprintf(w, "%s %s\n", name, strconv.FormatFloat(sample.Value, 'g', -1, 64))
+	}
+}
+
+func reply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warningf("Failed to write control API reply: %v", err)
+	}
+}
+
+func replyError(w http.ResponseWriter, status int, err error) {
+	reply(w, status, map[string]string{"error": err.Error()})
+}
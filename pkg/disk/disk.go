@@ -32,11 +32,43 @@ func CreateDisks(guest *api.Guest) error {
 	for i := range guest.Disks {
 		gd := guest.Disks[i]
 
+		if gd.BlockDevice {
+			if gd.KeyFile != "" {
+				return fmt.Errorf("encryption of the block device %s is not supported", gd.File)
+			}
+
+			if err := attachBlockDevice(&gd); err != nil {
+				return fmt.Errorf("failed to attach the block device %s: %v", gd.File, err)
+			}
+
+			log.Infof("Attached block device %s as disk %s", gd.File, gd.ID)
+
+			guest.Disks[i] = gd
+
+			continue
+		}
+
 		// set ID
-		gd.File = gd.ID + ".img"
+		gd.File = diskFileName(gd.ID)
 		// set XFS statically
 		gd.Filesystem = api.XFS
 
+		if err := validateOptions(&gd); err != nil {
+			return fmt.Errorf("invalid options for disk %s: %v", gd.ID, err)
+		}
+
+		if gd.KeyFile != "" {
+			if err := createEncryptedDisk(gd); err != nil {
+				return fmt.Errorf("failed to create the encrypted disk file %s: %v", gd.File, err)
+			}
+
+			log.Infof("Encrypted block disk %s with size %s ready", gd.ID, gd.Size)
+
+			guest.Disks[i] = gd
+
+			continue
+		}
+
 		if err := createDiskFile(gd.File, gd.Size); err != nil {
 			return fmt.Errorf("failed to create the disk file %s: %v", gd.File, err)
 		}
@@ -53,6 +85,32 @@ func CreateDisks(guest *api.Guest) error {
 	return nil
 }
 
+// diskFileName returns the file name of the disk with the given ID
+func diskFileName(id string) string {
+	return id + ".img"
+}
+
+// attachBlockDevice checks that the disk is backed by a block device, which
+// is neither created nor formatted as its content belongs to the volume
+func attachBlockDevice(gd *api.Disk) error {
+	info, err := os.Stat(gd.File)
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeDevice == 0 || info.Mode()&os.ModeCharDevice != 0 {
+		return fmt.Errorf("%s is not a block device", gd.File)
+	}
+
+	// bypass the page cache of the container, the volume has its own
+	if gd.Cache != api.CacheNone {
+		log.Infof("Disk %s: using cache=none for block device %s", gd.ID, gd.File)
+		gd.Cache = api.CacheNone
+	}
+
+	return validateOptions(gd)
+}
+
 func runMkfs(filesystem api.FsType, block string) error {
 	command := "mkfs." + string(filesystem)
 
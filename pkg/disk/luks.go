@@ -0,0 +1,162 @@
+/*
+
+Copyright 2020 Salvatore Mazzarino
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package disk
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/giantswarm/containervmm/pkg/api"
+)
+
+// magic bytes at the beginning of a LUKS header
+var luksMagic = []byte{'L', 'U', 'K', 'S', 0xba, 0xbe}
+
+// keyFiles are the memory files holding the passphrases of the environment
+// variables, by variable
+var (
+	keyFilesLock sync.Mutex
+	keyFiles     = map[string]string{}
+)
+
+// KeyFileFromEnv hands the passphrase held by the given environment
+// variable to QEMU without exposing it on its command line, nor writing it
+// to the storage of the node. The passphrase is held by a sealed memory
+// file, which QEMU and qemu-img read through the file descriptor table of
+// containervmm as long as it runs. The variable is read once, the disks
+// encrypted with the same variable sharing the memory file, and it is then
+// removed from the environment inherited by QEMU.
+func KeyFileFromEnv(name string) (string, error) {
+	keyFilesLock.Lock()
+	defer keyFilesLock.Unlock()
+
+	if keyFile, ok := keyFiles[name]; ok {
+		return keyFile, nil
+	}
+
+	passphrase, ok := os.LookupEnv(name)
+	if !ok || passphrase == "" {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+
+	fd, err := unix.MemfdCreate(fmt.Sprintf("containervmm-%s.key", name), unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	if err != nil {
+		return "", fmt.Errorf("failed to create key file: %v", err)
+	}
+
+	// the descriptor is left open on purpose, it is the only reference to
+	// the memory file
+	if _, err := unix.Write(fd, []byte(passphrase)); err != nil {
+		unix.Close(fd)
+		return "", fmt.Errorf("failed to write key file: %v", err)
+	}
+
+	seals := unix.F_SEAL_SHRINK | unix.F_SEAL_GROW | unix.F_SEAL_WRITE | unix.F_SEAL_SEAL
+	if _, err := unix.FcntlInt(uintptr(fd), unix.F_ADD_SEALS, seals); err != nil {
+		unix.Close(fd)
+		return "", fmt.Errorf("failed to seal key file: %v", err)
+	}
+
+	if err := os.Unsetenv(name); err != nil {
+		unix.Close(fd)
+		return "", fmt.Errorf("failed to remove %s from the environment: %v", name, err)
+	}
+
+	keyFile := fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), fd)
+	keyFiles[name] = keyFile
+
+	return keyFile, nil
+}
+
+// createEncryptedDisk creates a LUKS encrypted disk, unless it exists
+// already from a previous run, in which case it is opened as it is
+func createEncryptedDisk(gd api.Disk) error {
+	if _, err := os.Stat(gd.KeyFile); err != nil {
+		return fmt.Errorf("failed to read key file: %v", err)
+	}
+
+	encrypted, err := isLUKS(gd.File)
+	if err != nil {
+		return err
+	}
+
+	if encrypted {
+		log.Infof("Opening existing encrypted disk %s", gd.ID)
+
+		return nil
+	}
+
+	// The filesystem is created on a plain image, which is then encrypted
+	// into the disk file. The plain image only holds the metadata of the
+	// empty filesystem and it is removed straight away.
+	plainFile := gd.File + ".plain"
+	defer os.Remove(plainFile)
+
+	if err := createDiskFile(plainFile, gd.Size); err != nil {
+		return err
+	}
+
+	if err := runMkfs(gd.Filesystem, plainFile); err != nil {
+		return fmt.Errorf("failed to exec mkfs command: %v", err)
+	}
+
+	cmd := exec.Command("qemu-img", "convert",
+		"--object", fmt.Sprintf("secret,id=key,file=%s", gd.KeyFile),
+		"-f", "raw", "-O", "luks", "-o", "key-secret=key",
+		plainFile, gd.File)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		_ = os.Remove(gd.File)
+
+		return fmt.Errorf("failed to encrypt disk: %v: %s", err, stderr.String())
+	}
+
+	return nil
+}
+
+// isLUKS returns true if the file exists and starts with a LUKS header
+func isLUKS(filename string) (bool, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	magic := make([]byte, len(luksMagic))
+	if _, err := io.ReadFull(file, magic); err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+
+	if !bytes.Equal(magic, luksMagic) {
+		return false, fmt.Errorf("%s exists and it is not a LUKS encrypted disk", filename)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,138 @@
+/*
+
+Copyright 2020 Salvatore Mazzarino
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package disk
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/giantswarm/containervmm/pkg/api"
+)
+
+const (
+	// the defaults keep the page cache of the host and let the guest
+	// release the space of the sparse disk files with fstrim
+	defaultBus          = api.BusVirtioBlk
+	defaultCache        = api.CacheWriteback
+	defaultAIO          = api.AIOThreads
+	defaultDiscard      = api.DiscardUnmap
+	defaultDetectZeroes = api.DetectZeroesOff
+
+	// the defaults of QEMU
+	defaultWriteErrorPolicy = api.ErrorENOSPC
+	defaultReadErrorPolicy  = api.ErrorReport
+)
+
+// validateOptions sets the defaults of the block layer options which are
+// not set and checks that their combination is supported by QEMU
+func validateOptions(gd *api.Disk) error {
+	if gd.Bus == "" {
+		gd.Bus = defaultBus
+	}
+
+	if gd.Cache == "" {
+		gd.Cache = defaultCache
+	}
+
+	if gd.AIO == "" {
+		gd.AIO = defaultAIO
+	}
+
+	if gd.Discard == "" {
+		gd.Discard = defaultDiscard
+	}
+
+	if gd.DetectZeroes == "" {
+		gd.DetectZeroes = defaultDetectZeroes
+	}
+
+	if gd.WriteErrorPolicy == "" {
+		gd.WriteErrorPolicy = defaultWriteErrorPolicy
+	}
+
+	if gd.ReadErrorPolicy == "" {
+		gd.ReadErrorPolicy = defaultReadErrorPolicy
+	}
+
+	switch gd.Bus {
+	case api.BusVirtioBlk:
+		// the serial, which identifies the disk in the guest, is
+		// truncated to 20 characters by virtio-blk
+		if len(gd.ID) > 20 {
+			log.Warningf("Disk %s: IDs longer than 20 characters are truncated in /dev/disk/by-id", gd.ID)
+		}
+	case api.BusVirtioSCSI:
+		// QEMU refuses SCSI serials longer than 36 characters
+		if len(gd.ID) > 36 {
+			return fmt.Errorf("disk ID %q is longer than 36 characters, which virtio-scsi does not support", gd.ID)
+		}
+	default:
+		return fmt.Errorf("unknown bus %q", gd.Bus)
+	}
+
+	switch gd.Cache {
+	case api.CacheNone, api.CacheWriteback, api.CacheUnsafe:
+	default:
+		return fmt.Errorf("unknown cache mode %q", gd.Cache)
+	}
+
+	switch gd.AIO {
+	case api.AIOThreads, api.AIOIOUring:
+	case api.AIONative:
+		// Linux native AIO is only asynchronous with O_DIRECT
+		if gd.Cache != api.CacheNone {
+			log.Warningf("Disk %s: aio=native requires cache=none, falling back to aio=threads", gd.ID)
+			gd.AIO = api.AIOThreads
+		}
+	default:
+		return fmt.Errorf("unknown AIO engine %q", gd.AIO)
+	}
+
+	switch gd.Discard {
+	case api.DiscardIgnore, api.DiscardUnmap:
+	default:
+		return fmt.Errorf("unknown discard mode %q", gd.Discard)
+	}
+
+	switch gd.DetectZeroes {
+	case api.DetectZeroesOff, api.DetectZeroesOn:
+	case api.DetectZeroesUnmap:
+		if gd.Discard != api.DiscardUnmap {
+			log.Warningf("Disk %s: detect-zeroes=unmap requires discard=unmap, falling back to detect-zeroes=on", gd.ID)
+			gd.DetectZeroes = api.DetectZeroesOn
+		}
+	default:
+		return fmt.Errorf("unknown detect-zeroes mode %q", gd.DetectZeroes)
+	}
+
+	switch gd.WriteErrorPolicy {
+	case api.ErrorReport, api.ErrorStop, api.ErrorENOSPC:
+	default:
+		return fmt.Errorf("unknown write error policy %q", gd.WriteErrorPolicy)
+	}
+
+	// reads never run out of space
+	switch gd.ReadErrorPolicy {
+	case api.ErrorReport, api.ErrorStop:
+	default:
+		return fmt.Errorf("unknown read error policy %q", gd.ReadErrorPolicy)
+	}
+
+	return nil
+}
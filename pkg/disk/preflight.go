@@ -0,0 +1,194 @@
+/*
+
+Copyright 2020 Salvatore Mazzarino
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package disk
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"code.cloudfoundry.org/bytefmt"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/giantswarm/containervmm/pkg/api"
+)
+
+// size of the file probing the capabilities of the filesystem
+const probeSize = 1024 * 1024
+
+// PreflightConfig describes how strict the storage checks are
+type PreflightConfig struct {
+	// OvercommitRatio is the maximum ratio between the size of the sparse
+	// disks and the free space of the filesystem. If zero, the ratio is
+	// not checked.
+	OvercommitRatio float64
+
+	// FailOnOvercommit fails the checks when the ratio is exceeded,
+	// otherwise a warning is logged
+	FailOnOvercommit bool
+}
+
+// Preflight checks that the filesystem hosting the disk files is able to
+// hold the disks, reporting all the problems found at once
+func Preflight(disks []api.Disk, cfg PreflightConfig) error {
+	var problems []string
+
+	// all the disk files are created in the same directory
+	dir := filepath.Dir(diskFileName(""))
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return fmt.Errorf("failed to get filesystem stats of %s: %v", dir, err)
+	}
+
+	free := int64(stat.Bavail) * int64(stat.Bsize)
+
+	sparse, err := supportsSparseFiles(dir)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("failed to check support of sparse files: %v", err))
+	} else if !sparse {
+		log.Warningf("The filesystem of %s does not support sparse files, the disks are fully allocated", dir)
+	}
+
+	// sparse disks only take the space written by the guest, while the
+	// others are fully allocated when they are created
+	var sparseSize, allocatedSize int64
+	var direct []string
+
+	for _, gd := range disks {
+		if gd.BlockDevice {
+			continue
+		}
+
+		file := diskFileName(gd.ID)
+
+		size, err := formatSize(gd.Size)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("disk %s: invalid size %q: %v", gd.ID, gd.Size, err))
+			continue
+		}
+
+		if gd.Cache == api.CacheNone {
+			direct = append(direct, gd.ID)
+		}
+
+		if info, err := os.Stat(file); err == nil {
+			if gd.KeyFile != "" {
+				// existing encrypted disks are reused as they are
+				continue
+			}
+
+			// plain disks are recreated, freeing their space
+			if sys, ok := info.Sys().(*syscall.Stat_t); ok {
+				free += sys.Blocks * 512
+			}
+		}
+
+		// encrypting the disk writes all of its blocks
+		if sparse && gd.KeyFile == "" {
+			sparseSize += size
+		} else {
+			allocatedSize += size
+		}
+	}
+
+	if allocatedSize > free {
+		problems = append(problems, fmt.Sprintf("fully allocated disks need %s, but only %s are free in %s",
+			bytefmt.ByteSize(uint64(allocatedSize)), bytefmt.ByteSize(uint64(free)), dir))
+	}
+
+	if cfg.OvercommitRatio > 0 && sparseSize > 0 {
+		remaining := free - allocatedSize
+		if remaining < 0 {
+			remaining = 0
+		}
+
+		if remaining == 0 || float64(sparseSize)/float64(remaining) > cfg.OvercommitRatio {
+			msg := fmt.Sprintf("sparse disks of %s overcommit the %s free in %s beyond the ratio of %.2f",
+				bytefmt.ByteSize(uint64(sparseSize)), bytefmt.ByteSize(uint64(remaining)), dir, cfg.OvercommitRatio)
+
+			if cfg.FailOnOvercommit {
+				problems = append(problems, msg)
+			} else {
+				log.Warningf("Disks %s", msg)
+			}
+		}
+	}
+
+	if len(direct) > 0 {
+		if err := supportsDirectIO(dir); err != nil {
+			problems = append(problems, fmt.Sprintf("disks %s use cache=none, but O_DIRECT is not supported in %s: %v",
+				strings.Join(direct, ", "), dir, err))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("storage preflight checks failed: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// supportsSparseFiles creates a file with a hole and checks whether any
+// block has been allocated for it
+func supportsSparseFiles(dir string) (bool, error) {
+	file, err := os.CreateTemp(dir, ".preflight-sparse-")
+	if err != nil {
+		return false, err
+	}
+
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if err := file.Truncate(probeSize); err != nil {
+		return false, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	sys, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false, fmt.Errorf("unsupported file stats")
+	}
+
+	return sys.Blocks*512 < probeSize, nil
+}
+
+// supportsDirectIO checks that files can be opened with O_DIRECT, which
+// QEMU does with cache=none
+func supportsDirectIO(dir string) error {
+	probe, err := os.CreateTemp(dir, ".preflight-direct-")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(probe.Name())
+	probe.Close()
+
+	file, err := os.OpenFile(probe.Name(), os.O_RDWR|syscall.O_DIRECT, 0)
+	if err != nil {
+		return err
+	}
+
+	return file.Close()
+}
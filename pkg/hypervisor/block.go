@@ -0,0 +1,161 @@
+/*
+
+Copyright 2020 Salvatore Mazzarino
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hypervisor
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kata-containers/govmm/qemu"
+
+	"github.com/giantswarm/containervmm/pkg/api"
+)
+
+const (
+	// ID of the virtio-scsi controller hosting the SCSI disks
+	scsiControllerID = "scsi0"
+)
+
+// blockDevice is a virtio-blk or SCSI device backed by a drive. It is used
+// in place of qemu.BlockDevice, which does not support setting the cache,
+// discard and zero detection options of the drive.
+type blockDevice struct {
+	ID     string
+	File   string
+	Format qemu.BlockDeviceFormat
+
+	Bus api.DiskBus
+
+	// KeyFile holds the passphrase of a LUKS encrypted drive
+	KeyFile string
+
+	// SCSIID is the SCSI target ID of a disk on the virtio-scsi bus
+	SCSIID int
+
+	// IOThread is the ID of the IOThread handling the I/O of a virtio-blk
+	// device. SCSI disks use the IOThread of their controller.
+	IOThread string
+
+	// NumQueues is the number of virtqueues of a virtio-blk device
+	NumQueues uint32
+
+	Cache        api.CacheMode
+	AIO          api.AIOEngine
+	Discard      api.DiscardMode
+	DetectZeroes api.DetectZeroes
+
+	WriteErrorPolicy api.ErrorPolicy
+	ReadErrorPolicy  api.ErrorPolicy
+}
+
+// Valid returns true if the blockDevice structure is valid and complete.
+func (blkdev blockDevice) Valid() bool {
+	return blkdev.ID != "" && blkdev.File != ""
+}
+
+// QemuParams returns the qemu parameters built out of this block device.
+func (blkdev blockDevice) QemuParams(config *qemu.Config) []string {
+	var blkParams []string
+	var deviceParams []string
+	var qemuParams []string
+
+	if blkdev.Bus == api.BusVirtioSCSI {
+		deviceParams = append(deviceParams, "scsi-hd")
+		deviceParams = append(deviceParams, fmt.Sprintf(",bus=%s.0,channel=0", scsiControllerID))
+		deviceParams = append(deviceParams, fmt.Sprintf(",scsi-id=%d,lun=0", blkdev.SCSIID))
+		deviceParams = append(deviceParams, fmt.Sprintf(",drive=%s", blkdev.ID))
+		deviceParams = append(deviceParams, fmt.Sprintf(",serial=%s", blkdev.ID))
+	} else {
+		deviceParams = append(deviceParams, qemu.VirtioBlockTransport[qemu.TransportPCI])
+		deviceParams = append(deviceParams, fmt.Sprintf(",drive=%s", blkdev.ID))
+		deviceParams = append(deviceParams, ",scsi=off,config-wce=off,romfile=")
+		deviceParams = append(deviceParams, fmt.Sprintf(",serial=%s", blkdev.ID))
+
+		if blkdev.IOThread != "" {
+			deviceParams = append(deviceParams, fmt.Sprintf(",iothread=%s", blkdev.IOThread))
+		}
+
+		if blkdev.NumQueues > 1 {
+			deviceParams = append(deviceParams, fmt.Sprintf(",num-queues=%d", blkdev.NumQueues))
+		}
+	}
+
+	blkParams = append(blkParams, fmt.Sprintf("id=%s", blkdev.ID))
+	blkParams = append(blkParams, fmt.Sprintf(",file=%s", blkdev.File))
+	blkParams = append(blkParams, fmt.Sprintf(",file.node-name=%s", FileNodeName(blkdev.ID)))
+	blkParams = append(blkParams, fmt.Sprintf(",format=%s", blkdev.Format))
+	blkParams = append(blkParams, fmt.Sprintf(",if=%s", qemu.NoInterface))
+
+	if blkdev.KeyFile != "" {
+		secretID := blkdev.ID + "-key"
+
+		// the secret object has to be defined before the drive using it
+		qemuParams = append(qemuParams, "-object")
+		qemuParams = append(qemuParams, fmt.Sprintf("secret,id=%s,file=%s", secretID, blkdev.KeyFile))
+
+		blkParams = append(blkParams, fmt.Sprintf(",key-secret=%s", secretID))
+	}
+
+	if blkdev.Cache != "" {
+		blkParams = append(blkParams, fmt.Sprintf(",cache=%s", blkdev.Cache))
+	}
+
+	if blkdev.AIO != "" {
+		blkParams = append(blkParams, fmt.Sprintf(",aio=%s", blkdev.AIO))
+	}
+
+	if blkdev.Discard != "" {
+		blkParams = append(blkParams, fmt.Sprintf(",discard=%s", blkdev.Discard))
+	}
+
+	if blkdev.DetectZeroes != "" {
+		blkParams = append(blkParams, fmt.Sprintf(",detect-zeroes=%s", blkdev.DetectZeroes))
+	}
+
+	if blkdev.WriteErrorPolicy != "" {
+		blkParams = append(blkParams, fmt.Sprintf(",werror=%s", blkdev.WriteErrorPolicy))
+	}
+
+	if blkdev.ReadErrorPolicy != "" {
+		blkParams = append(blkParams, fmt.Sprintf(",rerror=%s", blkdev.ReadErrorPolicy))
+	}
+
+	qemuParams = append(qemuParams, "-device")
+	qemuParams = append(qemuParams, strings.Join(deviceParams, ""))
+
+	qemuParams = append(qemuParams, "-drive")
+	qemuParams = append(qemuParams, strings.Join(blkParams, ""))
+
+	return qemuParams
+}
+
+// FileNodeName returns the name of the node holding the data of the disk as
+// it is stored in its file, i.e. still encrypted for a LUKS encrypted disk
+func FileNodeName(diskID string) string {
+	return diskID + "-file"
+}
+
+// diskByIDPath returns the path under which udev exposes the disk in the
+// guest, derived from the serial given to the device
+func diskByIDPath(disk api.Disk) string {
+	if disk.Bus == api.BusVirtioSCSI {
+		return fmt.Sprintf("/dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_%s", disk.ID)
+	}
+
+	return fmt.Sprintf("/dev/disk/by-id/virtio-%s", disk.ID)
+}
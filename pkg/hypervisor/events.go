@@ -0,0 +1,288 @@
+/*
+
+Copyright 2020 Salvatore Mazzarino
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hypervisor
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kata-containers/govmm/qemu"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/giantswarm/containervmm/pkg/api"
+	"github.com/giantswarm/containervmm/pkg/control"
+)
+
+const (
+	// QEMU status of a VM stopped by a disk error with werror/rerror=stop
+	statusIOError = "io-error"
+
+	// timeout of the QMP commands resuming the VM
+	resumeTimeout = 10 * time.Second
+)
+
+// DiskErrorStatus is the I/O error state of the disks exposed by the
+// control API
+type DiskErrorStatus struct {
+	// Paused is set while the VM is stopped by a disk error
+	Paused *PausedOnError `json:"paused,omitempty"`
+
+	// Errors are the I/O errors of each disk
+	Errors map[string]DiskErrors `json:"errors"`
+}
+
+// PausedOnError is the disk error which stopped the VM
+type PausedOnError struct {
+	Disk   string    `json:"disk"`
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+}
+
+// DiskErrors are the I/O errors of a disk
+type DiskErrors struct {
+	Count      int       `json:"count"`
+	LastReason string    `json:"lastReason"`
+	LastError  time.Time `json:"lastError"`
+}
+
+// eventWatcher handles the events emitted by QEMU on the QMP socket
+type eventWatcher struct {
+	q *qemu.QMP
+
+	// interval between the attempts to resume a VM stopped by a disk
+	// error, zero to leave it stopped
+	resumeInterval time.Duration
+
+	lock     sync.Mutex
+	resuming bool
+
+	// the error state of the disks, protected by the lock
+	paused *PausedOnError
+	errors map[string]DiskErrors
+}
+
+func watchEvents(ctx context.Context, q *qemu.QMP, events <-chan qemu.QMPEvent, guest api.Guest, server *control.Server) {
+	w := &eventWatcher{
+		q:              q,
+		resumeInterval: guest.DiskErrorResumeInterval,
+		errors:         map[string]DiskErrors{},
+	}
+
+	server.AddStatus("disks", w.status)
+	server.AddMetrics(w.metrics)
+
+	go func() {
+		// the channel is closed when QEMU disconnects
+		for ev := range events {
+			switch ev.Name {
+			case "BLOCK_IO_ERROR":
+				w.blockIOError(ctx, ev)
+			case "RESUME":
+				w.resumed()
+			}
+		}
+	}()
+}
+
+// blockIOError logs the I/O error of a disk and, when the error stopped
+// the VM, tries to resume it periodically
+func (w *eventWatcher) blockIOError(ctx context.Context, ev qemu.QMPEvent) {
+	// the device is the drive ID, which is the ID of the disk
+	fields := log.Fields{
+		"disk":      ev.Data["device"],
+		"operation": ev.Data["operation"],
+		"action":    ev.Data["action"],
+	}
+
+	if nospace, ok := ev.Data["nospace"].(bool); ok && nospace {
+		fields["nospace"] = true
+	}
+
+	if reason, ok := ev.Data["reason"]; ok {
+		fields["reason"] = reason
+	}
+
+	log.WithFields(fields).Errorf("Disk I/O error")
+
+	disk := fmt.Sprint(ev.Data["device"])
+	reason := errorReason(ev)
+	now := time.Now().UTC()
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	errors := w.errors[disk]
+	errors.Count++
+	errors.LastReason = reason
+	errors.LastError = now
+	w.errors[disk] = errors
+
+	if ev.Data["action"] != "stop" {
+		return
+	}
+
+	// the VM stays stopped by the first error until it is resumed
+	if w.paused == nil {
+		w.paused = &PausedOnError{
+			Disk:   disk,
+			Reason: reason,
+			Since:  now,
+		}
+	}
+
+	if w.resumeInterval == 0 || w.resuming {
+		return
+	}
+
+	w.resuming = true
+
+	// The events are delivered by the QMP loop, which has to be free to
+	// process the responses of the commands
+	go w.resume(ctx)
+}
+
+// errorReason returns the reason of a disk error, as reported by QEMU
+func errorReason(ev qemu.QMPEvent) string {
+	if nospace, ok := ev.Data["nospace"].(bool); ok && nospace {
+		return "nospace"
+	}
+
+	if reason, ok := ev.Data["reason"].(string); ok && reason != "" {
+		return reason
+	}
+
+	return fmt.Sprintf("%v error", ev.Data["operation"])
+}
+
+// resumed clears the error state of a VM resumed, either automatically or
+// by a command on the QMP socket
+func (w *eventWatcher) resumed() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.paused != nil {
+		log.Infof("VM stopped by an I/O error of disk %s resumed", w.paused.Disk)
+		w.paused = nil
+	}
+}
+
+func (w *eventWatcher) status() interface{} {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	status := DiskErrorStatus{
+		Errors: map[string]DiskErrors{},
+	}
+
+	if w.paused != nil {
+		paused := *w.paused
+		status.Paused = &paused
+	}
+
+	for disk, errors := range w.errors {
+		status.Errors[disk] = errors
+	}
+
+	return status
+}
+
+func (w *eventWatcher) metrics() []control.Metric {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	paused := control.Metric{
+		Name:    "containervmm_vm_paused_on_io_error",
+		Help:    "Whether the VM is stopped by an I/O error of a disk, the disk and the reason being in the status.",
+		Type:    "gauge",
+		Samples: []control.Sample{{Value: 0}},
+	}
+
+	if w.paused != nil {
+		paused.Samples[0].Value = 1
+	}
+
+	errors := control.Metric{
+		Name: "containervmm_disk_io_errors_total",
+		Help: "Number of I/O errors reported by QEMU for a disk.",
+		Type: "counter",
+	}
+
+	var disks []string
+	for disk := range w.errors {
+		disks = append(disks, disk)
+	}
+
+	sort.Strings(disks)
+
+	for _, disk := range disks {
+		errors.Samples = append(errors.Samples, control.Sample{
+			Labels: map[string]string{"disk": disk},
+			Value:  float64(w.errors[disk].Count),
+		})
+	}
+
+	return []control.Metric{paused, errors}
+}
+
+// resume resumes the VM stopped by a disk error. QEMU retries the failed
+// request, so the VM is stopped again until the error is gone.
+func (w *eventWatcher) resume(ctx context.Context) {
+	defer func() {
+		w.lock.Lock()
+		w.resuming = false
+		w.lock.Unlock()
+	}()
+
+	for {
+		time.Sleep(w.resumeInterval)
+
+		status, err := w.queryStatus(ctx)
+		if err != nil {
+			log.Errorf("Failed to query the VM status: %v", err)
+			return
+		}
+
+		if status.Status != statusIOError {
+			return
+		}
+
+		log.Infof("Resuming VM stopped by a disk I/O error")
+
+		if err := w.cont(ctx); err != nil {
+			log.Errorf("Failed to resume the VM: %v", err)
+			return
+		}
+	}
+}
+
+func (w *eventWatcher) queryStatus(ctx context.Context) (qemu.StatusInfo, error) {
+	ctxTimeout, cancel := context.WithTimeout(ctx, resumeTimeout)
+	defer cancel()
+
+	return w.q.ExecuteQueryStatus(ctxTimeout)
+}
+
+func (w *eventWatcher) cont(ctx context.Context) error {
+	ctxTimeout, cancel := context.WithTimeout(ctx, resumeTimeout)
+	defer cancel()
+
+	return w.q.ExecuteCont(ctxTimeout)
+}
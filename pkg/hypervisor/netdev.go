@@ -0,0 +1,98 @@
+/*
+
+Copyright 2020 Salvatore Mazzarino
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hypervisor
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kata-containers/govmm/qemu"
+
+	"github.com/giantswarm/containervmm/pkg/api"
+)
+
+const (
+	// ID of the NIC connected to the user mode network stack
+	userNetDeviceID = "net0"
+)
+
+// netDevice is a qemu.NetDevice whose virtio-net device advertises the MTU
+// of the host network to the guest, which qemu.NetDevice does not support
+type netDevice struct {
+	qemu.NetDevice
+
+	// HostMTU is the MTU advertised to the guest, if not 0
+	HostMTU int
+}
+
+// QemuParams returns the qemu parameters built out of this network device.
+func (netdev netDevice) QemuParams(config *qemu.Config) []string {
+	qemuParams := netdev.NetDevice.QemuParams(config)
+
+	if netdev.HostMTU == 0 {
+		return qemuParams
+	}
+
+	for i := 0; i < len(qemuParams)-1; i++ {
+		if qemuParams[i] == "-device" {
+			qemuParams[i+1] += fmt.Sprintf(",host_mtu=%d", netdev.HostMTU)
+		}
+	}
+
+	return qemuParams
+}
+
+// userNetDevice is a virtio-net device connected to the user mode network
+// stack of QEMU, which is not supported by qemu.NetDevice
+type userNetDevice struct {
+	ID string
+
+	// PortMappings are the ports of the container forwarded to the guest
+	PortMappings []api.PortMapping
+}
+
+// Valid returns true if the userNetDevice structure is valid and complete.
+func (netdev userNetDevice) Valid() bool {
+	return netdev.ID != ""
+}
+
+// QemuParams returns the qemu parameters built out of this network device.
+func (netdev userNetDevice) QemuParams(config *qemu.Config) []string {
+	var netdevParams []string
+	var deviceParams []string
+	var qemuParams []string
+
+	netdevParams = append(netdevParams, "user")
+	netdevParams = append(netdevParams, fmt.Sprintf(",id=%s", netdev.ID))
+
+	for _, pm := range netdev.PortMappings {
+		netdevParams = append(netdevParams, fmt.Sprintf(",hostfwd=%s::%d-:%d", pm.Protocol, pm.HostPort, pm.GuestPort))
+	}
+
+	deviceParams = append(deviceParams, string(qemu.VirtioNetPCI))
+	deviceParams = append(deviceParams, fmt.Sprintf(",netdev=%s", netdev.ID))
+	deviceParams = append(deviceParams, ",romfile=")
+
+	qemuParams = append(qemuParams, "-netdev")
+	qemuParams = append(qemuParams, strings.Join(netdevParams, ""))
+
+	qemuParams = append(qemuParams, "-device")
+	qemuParams = append(qemuParams, strings.Join(deviceParams, ""))
+
+	return qemuParams
+}
@@ -26,14 +26,17 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 
 	"github.com/kata-containers/govmm/qemu"
 
 	"github.com/giantswarm/containervmm/pkg/api"
+	"github.com/giantswarm/containervmm/pkg/control"
 	"github.com/giantswarm/containervmm/pkg/logs"
 	"github.com/giantswarm/containervmm/pkg/util"
 )
@@ -45,11 +48,25 @@ const (
 	// QEMU QMP Socket
 	qmpUDS = "/tmp/qmp-socket"
 
+	// QMPControlSocket is a second QMP socket used by the subsystems that
+	// need to run commands which are not supported by govmm
+	QMPControlSocket = "/tmp/qmp-control-socket"
+
+	// GuestAgentSocket is the socket of the QEMU guest agent channel
+	GuestAgentSocket = "/tmp/qga-socket"
+
 	// console socket
 	consoleUDS = "console.sock"
 
+	// pid file of the daemonized QEMU process
+	pidFile = "/tmp/qemu.pid"
+
 	// shutdown timeout
 	powerdownTimeout = 1 * time.Minute
+
+	// time given to QEMU to exit once the QMP socket is closed, or once
+	// it is killed
+	exitTimeout = 10 * time.Second
 )
 
 // These kernel parameters will be appended
@@ -75,7 +92,7 @@ type qmpLogger struct {
 	*log.Logger
 }
 
-func ExecuteQEMU(guest api.Guest) error {
+func ExecuteQEMU(guest api.Guest, server *control.Server) error {
 	// create a context
 	ctx := context.Background()
 
@@ -96,8 +113,15 @@ func ExecuteQEMU(guest api.Guest) error {
 	// This channel will be closed when the instance dies.
 	disconnectedCh := make(chan struct{})
 
+	// This channel receives the QMP events and it is closed when the
+	// instance dies.
+	eventCh := make(chan qemu.QMPEvent)
+
 	// Set up our options.
-	cfg := qemu.QMPConfig{Logger: newQMPLogger()}
+	cfg := qemu.QMPConfig{
+		Logger:  newQMPLogger(),
+		EventCh: eventCh,
+	}
 
 	// Start monitoring the qemu instance.  This functon will block until we have
 	// connect to the QMP socket and received the welcome message.
@@ -111,15 +135,94 @@ func ExecuteQEMU(guest api.Guest) error {
 		return fmt.Errorf("failed to run QMP commmand: %v", err)
 	}
 
-	installSignalHandlers(ctx, q)
+	pid, err := readPidFile()
+	if err != nil {
+		// QEMU is not left running without containervmm
+		if err := q.ExecuteQuit(ctx); err != nil {
+			log.Errorf("QEMU quit failed with error: %v", err)
+		}
+
+		return err
+	}
+
+	watchEvents(ctx, q, eventCh, guest, server)
+
+	installSignalHandlers(ctx, q, pid)
 
 	// disconnectedCh is closed when the VM exits. This line blocks until this
 	// event occurs.
 	<-disconnectedCh
 
+	// The QMP socket is closed while QEMU exits, the network and the disks
+	// of the VM are only released once the process is gone
+	waitForExit(pid)
+
 	return nil
 }
 
+// readPidFile returns the pid of the daemonized QEMU process
+func readPidFile() (int, error) {
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read QEMU pid file: %v", err)
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid QEMU pid file: %v", err)
+	}
+
+	return pid, nil
+}
+
+// waitForExit waits for the QEMU process to exit, killing it once exitTimeout
+// expires
+func waitForExit(pid int) {
+	if waitForExitTimeout(pid, exitTimeout) {
+		return
+	}
+
+	log.Warningf("QEMU did not exit within %s, killing it", exitTimeout)
+
+	if err := unix.Kill(pid, unix.SIGKILL); err != nil {
+		log.Errorf("Failed to kill QEMU: %v", err)
+	}
+
+	if !waitForExitTimeout(pid, exitTimeout) {
+		log.Errorf("QEMU did not exit within %s once killed", exitTimeout)
+	}
+}
+
+// waitForExitTimeout returns true once the QEMU process exited, false if it
+// is still running once the timeout expires
+func waitForExitTimeout(pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		if exited(pid) {
+			return true
+		}
+
+		if time.Now().After(deadline) {
+			return false
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// exited returns true if the QEMU process is gone. When containervmm is the
+// init process of the container, the daemonized QEMU process is its child and
+// is reaped here.
+func exited(pid int) bool {
+	var status unix.WaitStatus
+	if wpid, err := unix.Wait4(pid, &status, unix.WNOHANG, nil); err == nil && wpid == pid {
+		return true
+	}
+
+	return unix.Kill(pid, 0) == unix.ESRCH
+}
+
 func newQMPLogger() qmpLogger {
 	return qmpLogger{
 		logs.Logger,
@@ -150,7 +253,7 @@ func createSandbox(ctx context.Context, guest api.Guest) (qemu.Config, error) {
 		return qemu.Config{}, fmt.Errorf("failed to create smp object: %v", err)
 	}
 
-	devices := buildDevices(guest)
+	devices := buildDevices(guest, smp.CPUs)
 
 	config := qemu.Config{
 		Name:       guest.Name,
@@ -165,6 +268,8 @@ func createSandbox(ctx context.Context, guest api.Guest) (qemu.Config, error) {
 		SMP:        smp,
 		QMPSockets: qmpSockets(),
 		Devices:    devices,
+		IOThreads:  ioThreads(guest.IOThreads),
+		PidFile:    pidFile,
 	}
 
 	fwcfgs := fwcfgs(guest.OS.IgnitionConfig)
@@ -215,8 +320,7 @@ func kernel(guest api.Guest) (qemu.Kernel, error) {
 		d := guest.Disks[i]
 
 		if d.IsRoot {
-			diskSerial := fmt.Sprintf("/dev/disk/by-id/virtio-%s", d.ID)
-			rootDisk := []string{"root", diskSerial}
+			rootDisk := []string{"root", diskByIDPath(d)}
 
 			kp = append(kp, rootDisk)
 
@@ -299,17 +403,47 @@ func qmpSockets() []qemu.QMPSocket {
 
 	q = append(q, qmpSocket)
 
+	controlSocket := qemu.QMPSocket{
+		Type:   qemu.Unix,
+		Name:   QMPControlSocket,
+		Server: true,
+		NoWait: true,
+	}
+
+	q = append(q, controlSocket)
+
 	return q
 }
 
-func buildDevices(guest api.Guest) []qemu.Device {
+func ioThreads(count int) []qemu.IOThread {
+	var t []qemu.IOThread
+
+	for i := 0; i < count; i++ {
+		t = append(t, qemu.IOThread{ID: ioThreadID(i)})
+	}
+
+	return t
+}
+
+func ioThreadID(index int) string {
+	return fmt.Sprintf("iothread%d", index)
+}
+
+func buildDevices(guest api.Guest, cpus uint32) []qemu.Device {
 	var devices []qemu.Device
 
 	// append all the network devices
-	devices = appendNetworkDevices(devices, guest.NICs)
+	if guest.NetworkMode == api.NetworkModeUser {
+		devices = append(devices, userNetDevice{
+			ID:           userNetDeviceID,
+			PortMappings: guest.PortMappings,
+		})
+	} else {
+		devices = appendNetworkDevices(devices, guest.NICs)
+	}
 
 	// append all the block devices
-	devices = appendBlockDevices(devices, guest.Disks)
+	devices = appendBlockDevices(devices, guest.Disks, guest.IOThreads, cpus)
 	// append all the FS devices
 	devices = appendFSDevices(devices, guest.HostVolumes)
 
@@ -340,43 +474,98 @@ func appendNetworkDevices(devices []qemu.Device, guestNICs []api.NetworkInterfac
 	return devices
 }
 
-func buildNetworkDevice(guestNIC api.NetworkInterface) qemu.NetDevice {
-	return qemu.NetDevice{
-		Type:       qemu.TAP,
-		ID:         guestNIC.TAP,
-		Driver:     qemu.VirtioNetPCI,
-		IFName:     guestNIC.TAP,
-		MACAddress: guestNIC.MacAddr,
-
-		// we configure NIC - no need to use any scripts
-		Script:     "no",
-		DownScript: "no",
+func buildNetworkDevice(guestNIC api.NetworkInterface) netDevice {
+	// the queues of the TAP and macvtap devices, which are TAP devices to
+	// QEMU, are handed to it as open files. The name is still needed for
+	// the device to be valid.
+	return netDevice{
+		NetDevice: qemu.NetDevice{
+			Type:       qemu.TAP,
+			ID:         guestNIC.TAP,
+			Driver:     qemu.VirtioNetPCI,
+			IFName:     guestNIC.TAP,
+			FDs:        guestNIC.FDs,
+			VHost:      len(guestNIC.VhostFDs) > 0,
+			VhostFDs:   guestNIC.VhostFDs,
+			MACAddress: guestNIC.MacAddr,
+
+			// we configure NIC - no need to use any scripts
+			Script:     "no",
+			DownScript: "no",
+		},
+		HostMTU: guestNIC.MTU,
 	}
 }
 
-func appendBlockDevices(devices []qemu.Device, guestDisks []api.Disk) []qemu.Device {
+func appendBlockDevices(devices []qemu.Device, guestDisks []api.Disk, ioThreads int, cpus uint32) []qemu.Device {
+	scsiDisks := 0
+
 	for i := range guestDisks {
 		blkDevice := guestDisks[i]
 
 		device := buildBlockDevice(blkDevice)
+
+		if device.Bus == api.BusVirtioSCSI {
+			// a single controller hosts all the SCSI disks
+			if scsiDisks == 0 {
+				devices = append(devices, buildSCSIController(ioThreads))
+			}
+
+			// the target IDs follow the order of the disks
+			device.SCSIID = scsiDisks
+			scsiDisks++
+		} else {
+			// spread the disks over the available IOThreads
+			if ioThreads > 0 {
+				device.IOThread = ioThreadID(i % ioThreads)
+			}
+
+			// one virtqueue per vCPU lets every vCPU submit requests
+			// without contending a single queue
+			device.NumQueues = cpus
+		}
+
 		devices = append(devices, device)
 	}
 
 	return devices
 }
 
-func buildBlockDevice(disk api.Disk) qemu.BlockDevice {
+func buildSCSIController(ioThreads int) qemu.SCSIController {
+	controller := qemu.SCSIController{
+		ID: scsiControllerID,
+	}
+
+	if ioThreads > 0 {
+		controller.IOThread = ioThreadID(0)
+	}
+
+	return controller
+}
+
+func buildBlockDevice(disk api.Disk) blockDevice {
 	// we define here because in the lib is not defined
 	var RAW qemu.BlockDeviceFormat = "raw"
+	var LUKS qemu.BlockDeviceFormat = "luks"
 
-	blk := qemu.BlockDevice{
-		Driver:    qemu.VirtioBlock,
-		ID:        disk.ID,
-		AIO:       qemu.Threads,
-		File:      disk.File,
-		Format:    RAW,
-		Interface: qemu.NoInterface,
-		Transport: qemu.TransportPCI,
+	format := RAW
+	if disk.KeyFile != "" {
+		format = LUKS
+	}
+
+	blk := blockDevice{
+		ID:           disk.ID,
+		File:         disk.File,
+		Format:       format,
+		Bus:          disk.Bus,
+		KeyFile:      disk.KeyFile,
+		Cache:        disk.Cache,
+		AIO:          disk.AIO,
+		Discard:      disk.Discard,
+		DetectZeroes: disk.DetectZeroes,
+
+		WriteErrorPolicy: disk.WriteErrorPolicy,
+		ReadErrorPolicy:  disk.ReadErrorPolicy,
 	}
 
 	return blk
@@ -400,6 +589,18 @@ func appendConsoleDevice(devices []qemu.Device) []qemu.Device {
 
 	devices = append(devices, console)
 
+	// the guest agent is optional in the guest, the channel is always there
+	guestAgent := qemu.CharDevice{
+		Driver:   qemu.VirtioSerialPort,
+		Backend:  qemu.Socket,
+		DeviceID: "channel0",
+		ID:       "charchannel0",
+		Path:     GuestAgentSocket,
+		Name:     "org.qemu.guest_agent.0",
+	}
+
+	devices = append(devices, guestAgent)
+
 	return devices
 }
 
@@ -454,7 +655,9 @@ func watchConsole() error {
 	return nil
 }
 
-func installSignalHandlers(ctx context.Context, q *qemu.QMP) {
+// installSignalHandlers powers the VM off on SIGTERM, and stops it on SIGQUIT.
+// QEMU exits once the guest is powered off, which ends ExecuteQEMU.
+func installSignalHandlers(ctx context.Context, q *qemu.QMP, pid int) {
 	go func() {
 		c := make(chan os.Signal, 1)
 		signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
@@ -474,10 +677,12 @@ func installSignalHandlers(ctx context.Context, q *qemu.QMP) {
 					err = q.ExecuteQuit(ctx)
 					if err != nil {
 						log.Errorf("QEMU quit failed with error: %v", err)
+
+						if err := unix.Kill(pid, unix.SIGKILL); err != nil {
+							log.Errorf("Failed to kill QEMU: %v", err)
+						}
 					}
 				}
-
-				q.Shutdown()
 			case s == syscall.SIGQUIT:
 				log.Infof("Caught SIGQUIT, forcing shutdown")
 
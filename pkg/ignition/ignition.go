@@ -0,0 +1,136 @@
+/*
+
+Copyright 2020 Salvatore Mazzarino
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ignition
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// version of the configs created from scratch, supported by all the Flatcar releases
+const defaultVersion = "2.2.0"
+
+// File is a file written to the guest filesystem by Ignition
+type File struct {
+	Path     string
+	Mode     int
+	Contents string
+}
+
+// AddFiles writes a copy of the Ignition config at the given path with the
+// files added to it, or a new config when the path is empty, and returns the
+// path of the copy. The files already defined by the config are left as they
+// are. The other fields of the config are kept untouched, whatever the
+// version of the config specification.
+func AddFiles(configPath string, files []File) (string, error) {
+	config := map[string]interface{}{
+		"ignition": map[string]interface{}{
+			"version": defaultVersion,
+		},
+	}
+
+	if configPath != "" {
+		data, err := os.ReadFile(configPath)
+		if err != nil {
+			return "", fmt.Errorf("failed to read Ignition config: %v", err)
+		}
+
+		config = map[string]interface{}{}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return "", fmt.Errorf("failed to parse Ignition config: %v", err)
+		}
+	}
+
+	version, _ := childMap(config, "ignition")["version"].(string)
+
+	// the files of the 2.x specification are written to a named filesystem
+	var filesystem string
+
+	switch {
+	case strings.HasPrefix(version, "2."):
+		filesystem = "root"
+	case strings.HasPrefix(version, "3."):
+	default:
+		return "", fmt.Errorf("unsupported Ignition config version %q", version)
+	}
+
+	storage := childMap(config, "storage")
+	configFiles, _ := storage["files"].([]interface{})
+
+	defined := map[string]struct{}{}
+	for _, f := range configFiles {
+		if entry, ok := f.(map[string]interface{}); ok {
+			if path, ok := entry["path"].(string); ok {
+				defined[path] = struct{}{}
+			}
+		}
+	}
+
+	for _, f := range files {
+		if _, ok := defined[f.Path]; ok {
+			log.Warningf("Ignition config already defines %s, leaving it as it is", f.Path)
+			continue
+		}
+
+		entry := map[string]interface{}{
+			"path": f.Path,
+			"mode": f.Mode,
+			"contents": map[string]interface{}{
+				"source": "data:;base64," + base64.StdEncoding.EncodeToString([]byte(f.Contents)),
+			},
+		}
+
+		if filesystem != "" {
+			entry["filesystem"] = filesystem
+		}
+
+		configFiles = append(configFiles, entry)
+	}
+
+	storage["files"] = configFiles
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode Ignition config: %v", err)
+	}
+
+	mergedPath := filepath.Join(os.TempDir(), "ignition-merged.json")
+	if err := os.WriteFile(mergedPath, data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write Ignition config: %v", err)
+	}
+
+	return mergedPath, nil
+}
+
+// childMap returns the object held by the given key, which is created if
+// missing
+func childMap(parent map[string]interface{}, key string) map[string]interface{} {
+	child, ok := parent[key].(map[string]interface{})
+	if !ok {
+		child = map[string]interface{}{}
+		parent[key] = child
+	}
+
+	return child
+}
@@ -0,0 +1,224 @@
+/*
+
+Copyright 2020 Salvatore Mazzarino
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/giantswarm/containervmm/pkg/api"
+)
+
+const (
+	// interval between the checks of the counters of the dropped frames
+	antiSpoofingInterval = 10 * time.Second
+
+	etherTypeIPv4 = 0x0800
+	etherTypeARP  = 0x0806
+	etherTypeIPv6 = 0x86dd
+
+	// type of the comment in the user data of a rule, as written by nft
+	nftablesUserDataComment = 0
+)
+
+// AddAntiSpoofingRules drops the frames of the guest whose source MAC address is not the one of its NIC, and
+// the IPv4, ARP and IPv6 packets whose source address is not one of the addresses of the NIC. The other
+// protocols, such as VLAN tagged frames, are dropped as well, but for the NICs without addresses which
+// are only checked for their MAC address. The dropped frames are counted, and logged.
+func AddAntiSpoofingRules(nics []api.NetworkInterface, changes *Changes) error {
+	conn := &nftables.Conn{}
+
+	table := conn.AddTable(&nftables.Table{
+		Name:   nftablesTableName,
+		Family: nftables.TableFamilyBridge,
+	})
+
+	chain := conn.AddChain(&nftables.Chain{
+		Name:     "prerouting",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityFilter,
+	})
+
+	for _, nic := range nics {
+		if err := addNICAntiSpoofingRules(conn, table, chain, nic); err != nil {
+			return err
+		}
+	}
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to add the anti-spoofing rules: %v", err)
+	}
+
+	changes.record(fmt.Sprintf("nftables bridge table %q", nftablesTableName), func() error {
+		conn := &nftables.Conn{}
+		conn.DelTable(table)
+
+		return conn.Flush()
+	})
+
+	go watchSpoofing(table, chain)
+
+	return nil
+}
+
+func addNICAntiSpoofingRules(conn *nftables.Conn, table *nftables.Table, chain *nftables.Chain, nic api.NetworkInterface) error {
+	mac, err := net.ParseMAC(nic.MacAddr)
+	if err != nil {
+		return fmt.Errorf("invalid MAC address of %q: %v", nic.TAP, err)
+	}
+
+	addRule := func(comment string, exprs ...expr.Any) {
+		// iifname <TAP>
+		rule := []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname(nic.TAP)},
+		}
+
+		conn.AddRule(&nftables.Rule{
+			Table:    table,
+			Chain:    chain,
+			Exprs:    append(rule, exprs...),
+			UserData: nftablesComment(fmt.Sprintf("%s %s", nic.TAP, comment)),
+		})
+	}
+
+	drop := []expr.Any{&expr.Counter{}, &expr.Verdict{Kind: expr.VerdictDrop}}
+	accept := []expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}}
+
+	// ether saddr != <MAC> counter drop
+	addRule("spoofed MAC address", append(matchPayload(expr.PayloadBaseLLHeader, 6, expr.CmpOpNeq, mac), drop...)...)
+
+	// the workloads of the guest configure the NICs without addresses
+	if len(nic.Addresses) == 0 {
+		return nil
+	}
+
+	ipv4 := []net.IP{net.IPv4zero.To4()}
+	ipv6 := []net.IP{net.IPv6unspecified}
+
+	for _, addr := range nic.Addresses {
+		if ip := addr.IP.To4(); ip != nil {
+			ipv4 = append(ipv4, ip)
+		} else {
+			ipv6 = append(ipv6, addr.IP.To16())
+		}
+	}
+
+	// ether type ip ip saddr <address> accept
+	for _, ip := range ipv4 {
+		addRule("IPv4", append(append(matchEtherType(etherTypeIPv4), matchPayload(expr.PayloadBaseNetworkHeader, 12, expr.CmpOpEq, ip)...), accept...)...)
+	}
+
+	addRule("spoofed IPv4 address", append(matchEtherType(etherTypeIPv4), drop...)...)
+
+	// ether type arp arp saddr ether != <MAC> counter drop
+	addRule("spoofed ARP MAC address", append(append(matchEtherType(etherTypeARP), matchPayload(expr.PayloadBaseNetworkHeader, 8, expr.CmpOpNeq, mac)...), drop...)...)
+
+	// ether type arp arp saddr ip <address> accept
+	for _, ip := range ipv4 {
+		addRule("ARP", append(append(matchEtherType(etherTypeARP), matchPayload(expr.PayloadBaseNetworkHeader, 14, expr.CmpOpEq, ip)...), accept...)...)
+	}
+
+	addRule("spoofed ARP address", append(matchEtherType(etherTypeARP), drop...)...)
+
+	// ether type ip6 ip6 saddr fe80::/10 accept
+	linkLocal := append(matchEtherType(etherTypeIPv6),
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 8, Len: 16},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 16, Mask: net.CIDRMask(10, 128), Xor: make([]byte, 16)},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: net.ParseIP("fe80::")},
+	)
+	addRule("IPv6 link-local", append(linkLocal, accept...)...)
+
+	// ether type ip6 ip6 saddr <address> accept
+	for _, ip := range ipv6 {
+		addRule("IPv6", append(append(matchEtherType(etherTypeIPv6), matchPayload(expr.PayloadBaseNetworkHeader, 8, expr.CmpOpEq, ip)...), accept...)...)
+	}
+
+	addRule("spoofed IPv6 address", append(matchEtherType(etherTypeIPv6), drop...)...)
+
+	// counter drop
+	addRule("unexpected protocol", drop...)
+
+	return nil
+}
+
+// matchEtherType returns the expressions matching the EtherType of a frame
+func matchEtherType(etherType uint16) []expr.Any {
+	return matchPayload(expr.PayloadBaseLLHeader, 12, expr.CmpOpEq, binaryutil.BigEndian.PutUint16(etherType))
+}
+
+// matchPayload returns the expressions comparing the payload at the given offset with the data
+func matchPayload(base expr.PayloadBase, offset uint32, op expr.CmpOp, data []byte) []expr.Any {
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: base, Offset: offset, Len: uint32(len(data))},
+		&expr.Cmp{Op: op, Register: 1, Data: data},
+	}
+}
+
+// nftablesComment returns the user data holding the comment of a rule, shown by nft
+func nftablesComment(comment string) []byte {
+	data := []byte{nftablesUserDataComment, byte(len(comment) + 1)}
+	data = append(data, comment...)
+
+	return append(data, 0)
+}
+
+// watchSpoofing logs the frames dropped by the anti-spoofing rules, until the rules are removed
+func watchSpoofing(table *nftables.Table, chain *nftables.Chain) {
+	dropped := map[string]uint64{}
+
+	ticker := time.NewTicker(antiSpoofingInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		conn := &nftables.Conn{}
+
+		rules, err := conn.GetRule(table, chain)
+		if err != nil {
+			log.Debugf("Stopping the anti-spoofing counters: %v", err)
+			return
+		}
+
+		for _, rule := range rules {
+			for _, e := range rule.Exprs {
+				counter, ok := e.(*expr.Counter)
+				if !ok {
+					continue
+				}
+
+				comment := string(rule.UserData)
+				if len(rule.UserData) > 3 {
+					comment = string(rule.UserData[2 : len(rule.UserData)-1])
+				}
+
+				if counter.Packets > dropped[comment] {
+					log.Warningf("Dropped %d frames of the guest: %s", counter.Packets-dropped[comment], comment)
+					dropped[comment] = counter.Packets
+				}
+			}
+		}
+	}
+}
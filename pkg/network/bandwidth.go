@@ -0,0 +1,507 @@
+/*
+
+Copyright 2020 Salvatore Mazzarino
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/giantswarm/containervmm/pkg/api"
+	"github.com/giantswarm/containervmm/pkg/control"
+)
+
+const (
+	// latency of the packets queued by the TBF qdiscs before being dropped
+	tbfLatency = 50 * time.Millisecond
+
+	// the default burst holds the traffic of 10ms, and at least a GSO packet of 64KiB
+	defaultBurstDuration = 10 * time.Millisecond
+	minDefaultBurst      = 64 * 1024
+)
+
+// bit rate units, as understood by tc
+var rateUnits = []struct {
+	suffix string
+	bits   uint64
+}{
+	{"tbit", 1000 * 1000 * 1000 * 1000},
+	{"gbit", 1000 * 1000 * 1000},
+	{"mbit", 1000 * 1000},
+	{"kbit", 1000},
+	{"bit", 1},
+}
+
+// BandwidthLimit limits the traffic of a NIC of the guest
+type BandwidthLimit struct {
+	// Rate is the rate in bytes per second
+	Rate uint64 `json:"rate"`
+
+	// Burst is the size in bytes of the bursts allowed above the rate. If zero, it holds the traffic of
+	// 10ms at the rate, and at least 64KiB.
+	Burst uint32 `json:"burst,omitempty"`
+}
+
+// ParseBandwidthLimits parses the bandwidth limits given as "[interface=]rate[:burst]", the rate in bits per
+// second, such as "100mbit", and the burst in bytes, such as "256K". The limits are returned by interface,
+// the limits without interface applying to all the interfaces under the empty name.
+func ParseBandwidthLimits(inputs []string) (map[string]BandwidthLimit, error) {
+	limits := map[string]BandwidthLimit{}
+
+	for _, input := range inputs {
+		var name string
+
+		value := input
+		if s := strings.SplitN(input, "=", 2); len(s) == 2 {
+			name, value = s[0], s[1]
+		}
+
+		limit, err := parseBandwidthLimit(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bandwidth limit %q: %v", input, err)
+		}
+
+		if _, ok := limits[name]; ok {
+			return nil, fmt.Errorf("duplicate bandwidth limit %q", input)
+		}
+
+		limits[name] = limit
+	}
+
+	return limits, nil
+}
+
+// parseBandwidthLimit parses a bandwidth limit given as "rate[:burst]"
+func parseBandwidthLimit(value string) (BandwidthLimit, error) {
+	var limit BandwidthLimit
+
+	rate := value
+	if s := strings.SplitN(value, ":", 2); len(s) == 2 {
+		rate = s[0]
+
+		burst, err := bytefmt.ToBytes(s[1])
+		if err != nil || burst == 0 || burst > math.MaxUint32 {
+			return limit, fmt.Errorf("invalid burst %q", s[1])
+		}
+
+		limit.Burst = uint32(burst)
+	}
+
+	var err error
+	if limit.Rate, err = parseRate(rate); err != nil {
+		return limit, fmt.Errorf("invalid rate %q: %v", rate, err)
+	}
+
+	return limit, nil
+}
+
+// parseRate parses a rate in bits per second and returns it in bytes per second
+func parseRate(input string) (uint64, error) {
+	value := strings.ToLower(strings.TrimSpace(input))
+	multiplier := uint64(1)
+
+	for _, unit := range rateUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSuffix(value, unit.suffix)
+			multiplier = unit.bits
+			break
+		}
+	}
+
+	bits, err := strconv.ParseFloat(value, 64)
+	if err != nil || bits <= 0 {
+		return 0, fmt.Errorf("expected format is a number of bits per second, such as \"100mbit\"")
+	}
+
+	rate := uint64(bits * float64(multiplier) / 8)
+	if rate == 0 {
+		return 0, fmt.Errorf("rate below 8bit")
+	}
+
+	return rate, nil
+}
+
+// formatRate formats a rate in bytes per second as a rate in bits per second
+func formatRate(rate uint64) string {
+	for _, unit := range rateUnits {
+		if bits := rate * 8; bits >= unit.bits {
+			return strconv.FormatFloat(float64(bits)/float64(unit.bits), 'f', -1, 64) + unit.suffix
+		}
+	}
+
+	return "0bit"
+}
+
+// BandwidthStatus is the limits of the traffic of an interface, nil when the traffic is not limited
+type BandwidthStatus struct {
+	Ingress *BandwidthLimit `json:"ingress,omitempty"`
+	Egress  *BandwidthLimit `json:"egress,omitempty"`
+}
+
+// bandwidthLimiter shapes the traffic of the TAP devices of the guest, the limits being changed at runtime
+// through the control API
+type bandwidthLimiter struct {
+	nics    []api.NetworkInterface
+	changes *Changes
+
+	lock    sync.Mutex
+	ingress map[string]BandwidthLimit
+	egress  map[string]BandwidthLimit
+
+	// ifbs are the IFB devices shaping the traffic sent by the guest, by interface
+	ifbs map[string]string
+}
+
+// AddBandwidthLimits shapes the traffic of the TAP devices of the guest. The ingress limits apply to the
+// traffic received by the guest, which is shaped by a TBF qdisc on the TAP device. The egress limits apply
+// to the traffic sent by the guest, received by the TAP device, which is redirected to an IFB device shaping
+// it with a TBF qdisc. The limits are given by interface of the container, or "nat" in nat network mode.
+// They are changed at runtime by the /network/bandwidth command of the control API.
+func AddBandwidthLimits(nics []api.NetworkInterface, ingress, egress map[string]BandwidthLimit, changes *Changes, server *control.Server) error {
+	names := map[string]bool{"": true}
+	for _, nic := range nics {
+		names[interfaceName(nic)] = true
+	}
+
+	for _, limits := range []map[string]BandwidthLimit{ingress, egress} {
+		for name := range limits {
+			if !names[name] {
+				return fmt.Errorf("no interface %q handed to the guest to limit its bandwidth", name)
+			}
+		}
+	}
+
+	netHandle, err := netlink.NewHandle()
+	if err != nil {
+		return err
+	}
+	defer netHandle.Delete()
+
+	l := &bandwidthLimiter{
+		nics:    nics,
+		changes: changes,
+		ingress: map[string]BandwidthLimit{},
+		egress:  map[string]BandwidthLimit{},
+		ifbs:    map[string]string{},
+	}
+
+	for _, nic := range nics {
+		name := interfaceName(nic)
+
+		if limit, ok := bandwidthLimit(ingress, name); ok {
+			if err := l.setIngressLimit(netHandle, nic, &limit); err != nil {
+				return err
+			}
+		}
+
+		if limit, ok := bandwidthLimit(egress, name); ok {
+			if err := l.setEgressLimit(netHandle, nic, &limit); err != nil {
+				return err
+			}
+		}
+	}
+
+	server.HandleCommand("/network/bandwidth", l.handleLimits)
+	server.AddStatus("bandwidth", l.status)
+
+	return nil
+}
+
+// bandwidthLimit returns the limit of an interface, or the limit of all the interfaces
+func bandwidthLimit(limits map[string]BandwidthLimit, name string) (BandwidthLimit, bool) {
+	if limit, ok := limits[name]; ok {
+		return limit, true
+	}
+
+	limit, ok := limits[""]
+
+	return limit, ok
+}
+
+// handleLimits changes the limits of an interface given by the "interface" parameter, or of all the
+// interfaces, to the "ingress" and "egress" parameters given as "rate[:burst]", or "none" to remove a limit
+func (l *bandwidthLimiter) handleLimits(r *http.Request) (interface{}, error) {
+	query := r.URL.Query()
+
+	var nics []api.NetworkInterface
+	for _, nic := range l.nics {
+		if name := query.Get("interface"); name == "" || name == interfaceName(nic) {
+			nics = append(nics, nic)
+		}
+	}
+
+	if len(nics) == 0 {
+		return nil, control.BadRequest(fmt.Errorf("no interface %q handed to the guest", query.Get("interface")))
+	}
+
+	if query.Get("ingress") == "" && query.Get("egress") == "" {
+		return nil, control.BadRequest(fmt.Errorf("expected an ingress or egress limit"))
+	}
+
+	limits := map[string]*BandwidthLimit{}
+	for _, direction := range []string{"ingress", "egress"} {
+		value := query.Get(direction)
+		if value == "" || value == "none" {
+			continue
+		}
+
+		limit, err := parseBandwidthLimit(value)
+		if err != nil {
+			return nil, control.BadRequest(fmt.Errorf("invalid %s limit: %v", direction, err))
+		}
+
+		limits[direction] = &limit
+	}
+
+	netHandle, err := netlink.NewHandle()
+	if err != nil {
+		return nil, err
+	}
+	defer netHandle.Delete()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for _, nic := range nics {
+		if query.Get("ingress") != "" {
+			if err := l.setIngressLimit(netHandle, nic, limits["ingress"]); err != nil {
+				return nil, err
+			}
+		}
+
+		if query.Get("egress") != "" {
+			if err := l.setEgressLimit(netHandle, nic, limits["egress"]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return l.currentStatus(), nil
+}
+
+func (l *bandwidthLimiter) status() interface{} {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.currentStatus()
+}
+
+// currentStatus returns the limits of each interface, the lock being held
+func (l *bandwidthLimiter) currentStatus() map[string]BandwidthStatus {
+	status := map[string]BandwidthStatus{}
+
+	for _, nic := range l.nics {
+		name := interfaceName(nic)
+
+		var s BandwidthStatus
+		if limit, ok := l.ingress[name]; ok {
+			s.Ingress = &limit
+		}
+
+		if limit, ok := l.egress[name]; ok {
+			s.Egress = &limit
+		}
+
+		status[name] = s
+	}
+
+	return status
+}
+
+// setIngressLimit sets or replaces the TBF qdisc of the TAP device of a NIC, or removes it if the limit is nil
+func (l *bandwidthLimiter) setIngressLimit(netHandle *netlink.Handle, nic api.NetworkInterface, limit *BandwidthLimit) error {
+	name := interfaceName(nic)
+
+	tap, err := netHandle.LinkByName(nic.TAP)
+	if err != nil {
+		return fmt.Errorf("failed to get interface %q by name: %v", nic.TAP, err)
+	}
+
+	if limit == nil {
+		if _, ok := l.ingress[name]; !ok {
+			return nil
+		}
+
+		if err := netHandle.QdiscDel(&netlink.Tbf{QdiscAttrs: tbfAttrs(tap)}); err != nil {
+			return fmt.Errorf("failed to remove the ingress bandwidth limit of %q: %v", nic.TAP, err)
+		}
+
+		delete(l.ingress, name)
+		log.Infof("Removed the limit of the traffic received by the guest on %q", nic.TAP)
+
+		return nil
+	}
+
+	if err := netHandle.QdiscReplace(tbf(tap, *limit)); err != nil {
+		return fmt.Errorf("failed to limit the ingress bandwidth of %q: %v", nic.TAP, err)
+	}
+
+	l.ingress[name] = *limit
+	log.Infof("Limiting the traffic received by the guest on %q to %s", nic.TAP, formatRate(limit.Rate))
+
+	return nil
+}
+
+// setEgressLimit sets or replaces the TBF qdisc of the IFB device of a NIC, or removes it if the limit is
+// nil. The IFB device is created by the first limit, and kept along with the redirection of the traffic
+// once the limit is removed.
+func (l *bandwidthLimiter) setEgressLimit(netHandle *netlink.Handle, nic api.NetworkInterface, limit *BandwidthLimit) error {
+	name := interfaceName(nic)
+
+	tap, err := netHandle.LinkByName(nic.TAP)
+	if err != nil {
+		return fmt.Errorf("failed to get interface %q by name: %v", nic.TAP, err)
+	}
+
+	ifbName, ok := l.ifbs[name]
+	if !ok {
+		if limit == nil {
+			return nil
+		}
+
+		ifbName = ifbNameOf(tap, name)
+		if err := limitEgress(netHandle, tap, ifbName, *limit, l.changes); err != nil {
+			return fmt.Errorf("failed to limit the egress bandwidth of %q: %v", nic.TAP, err)
+		}
+
+		l.ifbs[name] = ifbName
+		l.egress[name] = *limit
+		log.Infof("Limiting the traffic sent by the guest on %q to %s", nic.TAP, formatRate(limit.Rate))
+
+		return nil
+	}
+
+	ifb, err := netHandle.LinkByName(ifbName)
+	if err != nil {
+		return fmt.Errorf("failed to get interface %q by name: %v", ifbName, err)
+	}
+
+	if limit == nil {
+		if _, ok := l.egress[name]; !ok {
+			return nil
+		}
+
+		if err := netHandle.QdiscDel(&netlink.Tbf{QdiscAttrs: tbfAttrs(ifb)}); err != nil {
+			return fmt.Errorf("failed to remove the egress bandwidth limit of %q: %v", nic.TAP, err)
+		}
+
+		delete(l.egress, name)
+		log.Infof("Removed the limit of the traffic sent by the guest on %q", nic.TAP)
+
+		return nil
+	}
+
+	if err := netHandle.QdiscReplace(tbf(ifb, *limit)); err != nil {
+		return fmt.Errorf("failed to limit the egress bandwidth of %q: %v", nic.TAP, err)
+	}
+
+	l.egress[name] = *limit
+	log.Infof("Limiting the traffic sent by the guest on %q to %s", nic.TAP, formatRate(limit.Rate))
+
+	return nil
+}
+
+// ifbNameOf returns the name of the IFB device of a TAP device, "ifb-<interface>" if it fits in IFNAMSIZ,
+// or named after the index of the TAP device otherwise
+func ifbNameOf(tap netlink.Link, name string) string {
+	if ifbName := "ifb-" + name; len(ifbName) < unix.IFNAMSIZ {
+		return ifbName
+	}
+
+	return fmt.Sprintf("ifb%d", tap.Attrs().Index)
+}
+
+// limitEgress redirects the traffic received by the TAP device to an IFB device, where it is shaped. The
+// qdiscs and the filter go away along with the devices.
+func limitEgress(netHandle *netlink.Handle, tap netlink.Link, ifbName string, limit BandwidthLimit, changes *Changes) error {
+	la := netlink.NewLinkAttrs()
+	la.Name = ifbName
+	la.MTU = tap.Attrs().MTU
+
+	ifb := &netlink.Ifb{LinkAttrs: la}
+	if err := addLink(netHandle, ifb, changes); err != nil {
+		return fmt.Errorf("creation of IFB device %q failed: %v", ifbName, err)
+	}
+
+	if err := netHandle.QdiscAdd(tbf(ifb, limit)); err != nil {
+		return err
+	}
+
+	if err := netHandle.QdiscAdd(&netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: tap.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}); err != nil {
+		return err
+	}
+
+	// the u32 filter without selector matches all the packets
+	return netHandle.FilterAdd(&netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: tap.Attrs().Index,
+			Parent:    netlink.MakeHandle(0xffff, 0),
+			Priority:  1,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		Actions: []netlink.Action{netlink.NewMirredAction(ifb.Attrs().Index)},
+	})
+}
+
+// tbf returns the TBF root qdisc of a link shaping its traffic
+func tbf(link netlink.Link, limit BandwidthLimit) *netlink.Tbf {
+	burst := uint64(limit.Burst)
+	if burst == 0 {
+		burst = limit.Rate * uint64(defaultBurstDuration) / uint64(time.Second)
+		if burst < minDefaultBurst {
+			burst = minDefaultBurst
+		}
+	}
+
+	// the queue holds the burst and the traffic of the latency
+	queue := burst + limit.Rate*uint64(tbfLatency)/uint64(time.Second)
+	if queue > math.MaxUint32 {
+		queue = math.MaxUint32
+	}
+
+	return &netlink.Tbf{
+		QdiscAttrs: tbfAttrs(link),
+		Rate:       limit.Rate,
+		Buffer:     netlink.Xmittime(limit.Rate, uint32(burst)),
+		Limit:      uint32(queue),
+	}
+}
+
+// tbfAttrs returns the attributes of the TBF root qdisc of a link
+func tbfAttrs(link netlink.Link) netlink.QdiscAttrs {
+	return netlink.QdiscAttrs{
+		LinkIndex: link.Attrs().Index,
+		Handle:    netlink.MakeHandle(1, 0),
+		Parent:    netlink.HANDLE_ROOT,
+	}
+}
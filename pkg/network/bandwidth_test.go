@@ -0,0 +1,251 @@
+/*
+
+Copyright 2020 Salvatore Mazzarino
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestParseRate(t *testing.T) {
+	testCases := []struct {
+		input   string
+		want    uint64
+		wantErr bool
+	}{
+		{input: "100mbit", want: 12500000},
+		{input: "1gbit", want: 125000000},
+		{input: "1Gbit", want: 125000000},
+		{input: "1tbit", want: 125000000000},
+		{input: "1.5mbit", want: 187500},
+		{input: "512kbit", want: 64000},
+		{input: "8bit", want: 1},
+		{input: "8000", want: 1000},
+		{input: " 10mbit ", want: 1250000},
+		{input: "7bit", wantErr: true},
+		{input: "1", wantErr: true},
+		{input: "0", wantErr: true},
+		{input: "0mbit", wantErr: true},
+		{input: "-1mbit", wantErr: true},
+		{input: "10foo", wantErr: true},
+		{input: "10mbps", wantErr: true},
+		{input: "mbit", wantErr: true},
+		{input: "", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			rate, err := parseRate(tc.input)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %d", rate)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if rate != tc.want {
+				t.Errorf("expected %d, got %d", tc.want, rate)
+			}
+		})
+	}
+}
+
+func TestParseBandwidthLimits(t *testing.T) {
+	testCases := []struct {
+		name    string
+		inputs  []string
+		want    map[string]BandwidthLimit
+		wantErr bool
+	}{
+		{
+			name:   "all interfaces",
+			inputs: []string{"100mbit"},
+			want: map[string]BandwidthLimit{
+				"": {Rate: 12500000},
+			},
+		},
+		{
+			name:   "interface with burst",
+			inputs: []string{"eth1=1gbit:1M"},
+			want: map[string]BandwidthLimit{
+				"eth1": {Rate: 125000000, Burst: 1024 * 1024},
+			},
+		},
+		{
+			name:   "interface and default",
+			inputs: []string{"10mbit", "eth1=1gbit"},
+			want: map[string]BandwidthLimit{
+				"":     {Rate: 1250000},
+				"eth1": {Rate: 125000000},
+			},
+		},
+		{
+			name:   "burst of 4GiB",
+			inputs: []string{"100mbit:4294967295B"},
+			want: map[string]BandwidthLimit{
+				"": {Rate: 12500000, Burst: 4294967295},
+			},
+		},
+		{
+			name: "no limit",
+			want: map[string]BandwidthLimit{},
+		},
+		{
+			name:    "burst over 4GiB",
+			inputs:  []string{"100mbit:5G"},
+			wantErr: true,
+		},
+		{
+			name:    "zero burst",
+			inputs:  []string{"100mbit:0"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid burst",
+			inputs:  []string{"100mbit:foo"},
+			wantErr: true,
+		},
+		{
+			name:    "zero rate",
+			inputs:  []string{"eth1=0"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown unit",
+			inputs:  []string{"eth1=10foo"},
+			wantErr: true,
+		},
+		{
+			name:    "duplicate interface",
+			inputs:  []string{"eth1=10mbit", "eth1=20mbit"},
+			wantErr: true,
+		},
+		{
+			name:    "duplicate default",
+			inputs:  []string{"10mbit", "20mbit"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			limits, err := ParseBandwidthLimits(tc.inputs)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", limits)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(limits) != len(tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, limits)
+			}
+
+			for name, want := range tc.want {
+				if limit, ok := limits[name]; !ok || limit != want {
+					t.Errorf("expected limit %+v of %q, got %+v", want, name, limit)
+				}
+			}
+		})
+	}
+}
+
+func TestFormatRate(t *testing.T) {
+	testCases := []struct {
+		rate uint64
+		want string
+	}{
+		{rate: 125000000000, want: "1tbit"},
+		{rate: 125000000, want: "1gbit"},
+		{rate: 187500, want: "1.5mbit"},
+		{rate: 64000, want: "512kbit"},
+		{rate: 1, want: "8bit"},
+		{rate: 0, want: "0bit"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.want, func(t *testing.T) {
+			if rate := formatRate(tc.rate); rate != tc.want {
+				t.Errorf("expected %s, got %s", tc.want, rate)
+			}
+		})
+	}
+}
+
+func TestBandwidthLimit(t *testing.T) {
+	limits := map[string]BandwidthLimit{
+		"":     {Rate: 1250000},
+		"eth1": {Rate: 125000000},
+	}
+
+	testCases := []struct {
+		name   string
+		limits map[string]BandwidthLimit
+		want   BandwidthLimit
+		found  bool
+	}{
+		{name: "eth1", limits: limits, want: BandwidthLimit{Rate: 125000000}, found: true},
+		{name: "eth0", limits: limits, want: BandwidthLimit{Rate: 1250000}, found: true},
+		{name: "eth0", limits: map[string]BandwidthLimit{"eth1": {Rate: 1}}},
+		{name: "eth0"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			limit, found := bandwidthLimit(tc.limits, tc.name)
+			if found != tc.found || limit != tc.want {
+				t.Errorf("expected %+v %t, got %+v %t", tc.want, tc.found, limit, found)
+			}
+		})
+	}
+}
+
+func TestIFBNameOf(t *testing.T) {
+	testCases := []struct {
+		name string
+		want string
+	}{
+		{name: "eth0", want: "ifb-eth0"},
+		{name: "nat", want: "ifb-nat"},
+		{name: "net1234567", want: "ifb-net1234567"},
+		{name: "net12345678", want: "ifb-net12345678"},
+		{name: "net123456789", want: "ifb42"},
+		{name: "averylongtap123", want: "ifb42"},
+	}
+
+	tap := &netlink.Tuntap{LinkAttrs: netlink.LinkAttrs{Index: 42}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if name := ifbNameOf(tap, tc.name); name != tc.want {
+				t.Errorf("expected %s, got %s", tc.want, name)
+			}
+		})
+	}
+}
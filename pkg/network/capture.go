@@ -0,0 +1,519 @@
+/*
+
+Copyright 2020 Salvatore Mazzarino
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/nftables/binaryutil"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/giantswarm/containervmm/pkg/api"
+	"github.com/giantswarm/containervmm/pkg/control"
+)
+
+const (
+	// the captured packets are not truncated, the GSO packets of the guest reach 64KiB
+	captureSnapLen = 262144
+
+	pcapMagic        = 0xa1b2c3d4
+	pcapLinkTypeEth  = 1
+	pcapHeaderLen    = 24
+	pcapRecordHdrLen = 16
+
+	captureTimeFormat = "20060102T150405.000000Z"
+
+	// captureStopInterval is how often a capture waiting for frames checks whether it is stopped
+	captureStopInterval = 200 * time.Millisecond
+)
+
+// CaptureConfig configures the capture of the traffic of the guest
+type CaptureConfig struct {
+	// Dir is the directory of the pcap files
+	Dir string
+
+	// MaxSize is the size in bytes above which a new file is started. If zero, the files grow unbounded.
+	MaxSize uint64
+
+	// MaxAge is the age above which a new file is started. If zero, the files are not rotated by age.
+	MaxAge time.Duration
+
+	// MaxFiles is the number of files kept by interface, the oldest ones being removed. If zero, all the
+	// files are kept.
+	MaxFiles int
+
+	// Filter is the BPF program selecting the captured packets. If empty, all the packets are captured.
+	Filter []unix.SockFilter
+}
+
+// ParseBPFFilter parses a BPF program as printed by "tcpdump -ddd", the number of instructions followed by
+// the instructions as "code jt jf k", separated by newlines or commas
+func ParseBPFFilter(input string) ([]unix.SockFilter, error) {
+	lines := strings.FieldsFunc(input, func(r rune) bool { return r == '\n' || r == ',' })
+	if len(lines) == 0 {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(lines[0]))
+	if err != nil || count != len(lines)-1 || count > unix.BPF_MAXINSNS {
+		return nil, fmt.Errorf("invalid BPF filter, expected the number of instructions and the instructions as printed by tcpdump -ddd")
+	}
+
+	var filter []unix.SockFilter
+
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("invalid BPF instruction %q, expected format is \"code jt jf k\"", line)
+		}
+
+		var values [4]uint64
+		for i, bits := range []int{16, 8, 8, 32} {
+			if values[i], err = strconv.ParseUint(fields[i], 10, bits); err != nil {
+				return nil, fmt.Errorf("invalid BPF instruction %q: %v", line, err)
+			}
+		}
+
+		filter = append(filter, unix.SockFilter{
+			Code: uint16(values[0]),
+			Jt:   uint8(values[1]),
+			Jf:   uint8(values[2]),
+			K:    uint32(values[3]),
+		})
+	}
+
+	return filter, nil
+}
+
+// CaptureStatus is the state of the capture of the traffic of an interface
+type CaptureStatus struct {
+	TAP     string    `json:"tap"`
+	Started time.Time `json:"started"`
+	File    string    `json:"file,omitempty"`
+}
+
+// capturer captures the traffic of the TAP devices of the guest, the captures being started and stopped at
+// runtime through the control API
+type capturer struct {
+	nics   []api.NetworkInterface
+	config CaptureConfig
+
+	lock     sync.Mutex
+	captures map[string]*capture
+}
+
+// StartCapture captures the traffic of the TAP devices of the guest to pcap files, until the devices are
+// gone. The interfaces are the ones of the container, or "nat" in nat network mode. The captures are
+// started and stopped at runtime by the /network/capture/start and /network/capture/stop commands of the
+// control API.
+func StartCapture(nics []api.NetworkInterface, interfaces []string, config CaptureConfig, server *control.Server) error {
+	cp := &capturer{
+		nics:     nics,
+		config:   config,
+		captures: map[string]*capture{},
+	}
+
+	for _, name := range interfaces {
+		nic, ok := cp.nic(name)
+		if !ok {
+			return fmt.Errorf("no interface %q handed to the guest to capture its traffic", name)
+		}
+
+		if err := cp.start(nic, config.Filter); err != nil {
+			return err
+		}
+	}
+
+	server.HandleCommand("/network/capture/start", cp.handleStart)
+	server.HandleCommand("/network/capture/stop", cp.handleStop)
+	server.AddStatus("capture", cp.status)
+
+	return nil
+}
+
+// nic returns the NIC of the guest of an interface
+func (cp *capturer) nic(name string) (api.NetworkInterface, bool) {
+	for _, nic := range cp.nics {
+		if interfaceName(nic) == name {
+			return nic, true
+		}
+	}
+
+	return api.NetworkInterface{}, false
+}
+
+// selectNICs returns the NIC of the interface given by the "interface" parameter, or all the NICs
+func (cp *capturer) selectNICs(r *http.Request) ([]api.NetworkInterface, error) {
+	name := r.URL.Query().Get("interface")
+	if name == "" {
+		return cp.nics, nil
+	}
+
+	nic, ok := cp.nic(name)
+	if !ok {
+		return nil, control.BadRequest(fmt.Errorf("no interface %q handed to the guest", name))
+	}
+
+	return []api.NetworkInterface{nic}, nil
+}
+
+// handleStart starts the capture of an interface given by the "interface" parameter, or of all the
+// interfaces, with the BPF program given by the "filter" parameter or by the configuration
+func (cp *capturer) handleStart(r *http.Request) (interface{}, error) {
+	nics, err := cp.selectNICs(r)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := cp.config.Filter
+	if value := r.URL.Query().Get("filter"); value != "" {
+		if filter, err = ParseBPFFilter(value); err != nil {
+			return nil, control.BadRequest(err)
+		}
+	}
+
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	for _, nic := range nics {
+		if c, ok := cp.captures[interfaceName(nic)]; ok && c.running() {
+			return nil, control.BadRequest(fmt.Errorf("the traffic of %q is already captured", interfaceName(nic)))
+		}
+	}
+
+	for _, nic := range nics {
+		if err := cp.start(nic, filter); err != nil {
+			return nil, err
+		}
+	}
+
+	return cp.currentStatus(), nil
+}
+
+// handleStop stops the capture of an interface given by the "interface" parameter, or of all the interfaces,
+// once the socket and the current file are closed
+func (cp *capturer) handleStop(r *http.Request) (interface{}, error) {
+	nics, err := cp.selectNICs(r)
+	if err != nil {
+		return nil, err
+	}
+
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	var stopped bool
+	for _, nic := range nics {
+		if c, ok := cp.captures[interfaceName(nic)]; ok {
+			c.stop()
+			delete(cp.captures, interfaceName(nic))
+			stopped = true
+		}
+	}
+
+	if !stopped && r.URL.Query().Get("interface") != "" {
+		return nil, control.BadRequest(fmt.Errorf("the traffic of %q is not captured", r.URL.Query().Get("interface")))
+	}
+
+	return cp.currentStatus(), nil
+}
+
+// start opens the packet socket of the TAP device of a NIC and writes its frames to pcap files
+func (cp *capturer) start(nic api.NetworkInterface, filter []unix.SockFilter) error {
+	if err := os.MkdirAll(cp.config.Dir, 0755); err != nil {
+		return fmt.Errorf("failed to create the capture directory: %v", err)
+	}
+
+	fd, err := openCaptureSocket(nic.TAP, filter)
+	if err != nil {
+		return fmt.Errorf("failed to capture the traffic of %q: %v", nic.TAP, err)
+	}
+
+	c := &capture{
+		tap:     nic.TAP,
+		fd:      fd,
+		config:  cp.config,
+		started: time.Now(),
+		stopCh:  make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+
+	log.Infof("Capturing the traffic of %q to %s", nic.TAP, cp.config.Dir)
+
+	cp.captures[interfaceName(nic)] = c
+
+	go c.run()
+
+	return nil
+}
+
+func (cp *capturer) status() interface{} {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	return cp.currentStatus()
+}
+
+// currentStatus returns the running captures by interface, the lock being held
+func (cp *capturer) currentStatus() map[string]CaptureStatus {
+	status := map[string]CaptureStatus{}
+
+	for name, c := range cp.captures {
+		if !c.running() {
+			// the TAP device is gone, or the file could not be written
+			delete(cp.captures, name)
+			continue
+		}
+
+		status[name] = CaptureStatus{
+			TAP:     c.tap,
+			Started: c.started,
+			File:    c.fileName(),
+		}
+	}
+
+	return status
+}
+
+// openCaptureSocket opens a packet socket receiving the frames sent and received by an interface. The
+// filter is attached before the socket is bound, so that no frame gets through unfiltered.
+func openCaptureSocket(name string, filter []unix.SockFilter) (int, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return -1, err
+	}
+
+	// the socket receives no frame until it is bound to a protocol
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("failed to open packet socket: %v", err)
+	}
+
+	if len(filter) > 0 {
+		prog := &unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+		if err := unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, prog); err != nil {
+			unix.Close(fd)
+			return -1, fmt.Errorf("failed to attach BPF filter: %v", err)
+		}
+	}
+
+	tv := unix.NsecToTimeval(captureStopInterval.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("failed to set packet socket timeout: %v", err)
+	}
+
+	addr := &unix.SockaddrLinklayer{
+		Protocol: htons(unix.ETH_P_ALL),
+		Ifindex:  iface.Index,
+	}
+
+	if err := unix.Bind(fd, addr); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("failed to bind packet socket: %v", err)
+	}
+
+	return fd, nil
+}
+
+// capture writes the frames of a packet socket to rotated pcap files
+type capture struct {
+	tap     string
+	fd      int
+	config  CaptureConfig
+	started time.Time
+
+	// stopCh is closed to stop the capture, doneCh once the socket and the file are closed
+	stopCh chan struct{}
+	doneCh chan struct{}
+
+	// lock guards the current file, read by the status
+	lock    sync.Mutex
+	file    *os.File
+	size    uint64
+	created time.Time
+	files   []string
+}
+
+func (c *capture) run() {
+	defer close(c.doneCh)
+	defer unix.Close(c.fd)
+	defer c.closeFile()
+
+	buf := make([]byte, captureSnapLen)
+
+	for {
+		select {
+		case <-c.stopCh:
+			log.Infof("Stopped the capture of the traffic of %q", c.tap)
+			return
+		default:
+		}
+
+		// the length of the frame is returned even when it is truncated
+		n, _, err := unix.Recvfrom(c.fd, buf, unix.MSG_TRUNC)
+		if err == unix.EINTR || err == unix.EAGAIN {
+			continue
+		}
+
+		if err != nil {
+			log.Infof("Stopping the capture of the traffic of %q: %v", c.tap, err)
+			return
+		}
+
+		if err := c.write(time.Now(), buf, n); err != nil {
+			log.Errorf("Stopping the capture of the traffic of %q: %v", c.tap, err)
+			return
+		}
+	}
+}
+
+// stop stops the capture and waits for the socket and the file to be closed
+func (c *capture) stop() {
+	close(c.stopCh)
+	<-c.doneCh
+}
+
+// running returns whether the frames are still captured
+func (c *capture) running() bool {
+	select {
+	case <-c.doneCh:
+		return false
+	default:
+		return true
+	}
+}
+
+// fileName returns the path of the current file, or an empty string before the first frame
+func (c *capture) fileName() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.file == nil {
+		return ""
+	}
+
+	return c.file.Name()
+}
+
+func (c *capture) closeFile() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+	}
+}
+
+// write writes a frame of the given length to the current file, starting a new file when needed
+func (c *capture) write(ts time.Time, buf []byte, length int) error {
+	captured := length
+	if captured > len(buf) {
+		captured = len(buf)
+	}
+
+	recordLen := uint64(pcapRecordHdrLen + captured)
+
+	if c.file == nil ||
+		(c.config.MaxSize > 0 && c.size+recordLen > c.config.MaxSize && c.size > pcapHeaderLen) ||
+		(c.config.MaxAge > 0 && ts.Sub(c.created) >= c.config.MaxAge) {
+		if err := c.rotate(ts); err != nil {
+			return err
+		}
+	}
+
+	record := make([]byte, pcapRecordHdrLen, recordLen)
+	binary.LittleEndian.PutUint32(record[0:], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(captured))
+	binary.LittleEndian.PutUint32(record[12:], uint32(length))
+	record = append(record, buf[:captured]...)
+
+	if _, err := c.file.Write(record); err != nil {
+		return fmt.Errorf("failed to write %s: %v", c.file.Name(), err)
+	}
+
+	c.size += recordLen
+
+	return nil
+}
+
+// rotate closes the current file, starts a new one and removes the oldest ones
+func (c *capture) rotate(ts time.Time) error {
+	if c.file != nil {
+		if err := c.file.Close(); err != nil {
+			return fmt.Errorf("failed to close %s: %v", c.file.Name(), err)
+		}
+	}
+
+	path := filepath.Join(c.config.Dir, fmt.Sprintf("%s-%s.pcap", c.tap, ts.UTC().Format(captureTimeFormat)))
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", path, err)
+	}
+
+	header := make([]byte, pcapHeaderLen)
+	binary.LittleEndian.PutUint32(header[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], captureSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkTypeEth)
+
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+
+	c.lock.Lock()
+	c.file = file
+	c.lock.Unlock()
+
+	c.size = pcapHeaderLen
+	c.created = ts
+	c.files = append(c.files, path)
+
+	for c.config.MaxFiles > 0 && len(c.files) > c.config.MaxFiles {
+		if err := os.Remove(c.files[0]); err != nil && !os.IsNotExist(err) {
+			log.Warningf("Failed to remove capture file: %v", err)
+		}
+
+		c.files = c.files[1:]
+	}
+
+	return nil
+}
+
+// htons converts a short from the host byte order to the network byte order
+func htons(v uint16) uint16 {
+	if binaryutil.NativeEndian.PutUint16(1)[0] == 1 {
+		return v<<8 | v>>8
+	}
+
+	return v
+}
@@ -0,0 +1,236 @@
+/*
+
+Copyright 2020 Salvatore Mazzarino
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/giantswarm/containervmm/pkg/api"
+)
+
+func TestParseBPFFilter(t *testing.T) {
+	// tcpdump -ddd arp
+	arp := []unix.SockFilter{
+		{Code: 40, Jt: 0, Jf: 0, K: 12},
+		{Code: 21, Jt: 0, Jf: 1, K: 2054},
+		{Code: 6, Jt: 0, Jf: 0, K: 262144},
+		{Code: 6, Jt: 0, Jf: 0, K: 0},
+	}
+
+	testCases := []struct {
+		name    string
+		input   string
+		want    []unix.SockFilter
+		wantErr bool
+	}{
+		{
+			name:  "newlines",
+			input: "4\n40 0 0 12\n21 0 1 2054\n6 0 0 262144\n6 0 0 0\n",
+			want:  arp,
+		},
+		{
+			name:  "commas",
+			input: "4,40 0 0 12,21 0 1 2054,6 0 0 262144,6 0 0 0",
+			want:  arp,
+		},
+		{
+			name: "empty",
+		},
+		{
+			name:    "too few instructions",
+			input:   "4\n40 0 0 12\n21 0 1 2054\n6 0 0 262144",
+			wantErr: true,
+		},
+		{
+			name:    "too many instructions",
+			input:   "1\n40 0 0 12\n21 0 1 2054",
+			wantErr: true,
+		},
+		{
+			name:    "missing count",
+			input:   "40 0 0 12",
+			wantErr: true,
+		},
+		{
+			name:    "missing field",
+			input:   "1\n40 0 12",
+			wantErr: true,
+		},
+		{
+			name:    "jump out of range",
+			input:   "1\n21 256 0 2054",
+			wantErr: true,
+		},
+		{
+			name:    "code out of range",
+			input:   "1\n65536 0 0 0",
+			wantErr: true,
+		},
+		{
+			name:    "k out of range",
+			input:   "1\n6 0 0 4294967296",
+			wantErr: true,
+		},
+		{
+			name:    "negative value",
+			input:   "1\n6 0 0 -1",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			filter, err := ParseBPFFilter(tc.input)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", filter)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(filter, tc.want) {
+				t.Errorf("expected %v, got %v", tc.want, filter)
+			}
+		})
+	}
+}
+
+func TestCapturer(t *testing.T) {
+	err := inNetworkNamespace(func() error {
+		la := netlink.NewLinkAttrs()
+		la.Name = "tap-eth0"
+
+		link := &netlink.Bridge{LinkAttrs: la}
+		if err := netlink.LinkAdd(link); err != nil {
+			return err
+		}
+
+		if err := netlink.LinkSetUp(link); err != nil {
+			return err
+		}
+
+		cp := &capturer{
+			nics:     []api.NetworkInterface{{TAP: la.Name}},
+			config:   CaptureConfig{Dir: t.TempDir()},
+			captures: map[string]*capture{},
+		}
+
+		if _, err := cp.handleStart(httptest.NewRequest("POST", "/network/capture/start?interface=eth1", nil)); err == nil {
+			return fmt.Errorf("expected an error starting the capture of an unknown interface")
+		}
+
+		// tcpdump -ddd ether proto 0x88b5
+		query := url.Values{"interface": {"eth0"}, "filter": {"4,40 0 0 12,21 0 1 34997,6 0 0 262144,6 0 0 0"}}
+
+		if _, err := cp.handleStart(httptest.NewRequest("POST", "/network/capture/start?"+query.Encode(), nil)); err != nil {
+			return err
+		}
+
+		if _, err := cp.handleStart(httptest.NewRequest("POST", "/network/capture/start?interface=eth0", nil)); err == nil {
+			return fmt.Errorf("expected an error starting the capture twice")
+		}
+
+		if err := sendFrame(la.Name); err != nil {
+			return err
+		}
+
+		var file string
+		for start := time.Now(); file == "" && time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+			file = cp.status().(map[string]CaptureStatus)["eth0"].File
+		}
+
+		if file == "" {
+			return fmt.Errorf("expected the frame to be captured")
+		}
+
+		c := cp.captures["eth0"]
+
+		status, err := cp.handleStop(httptest.NewRequest("POST", "/network/capture/stop?interface=eth0", nil))
+		if err != nil {
+			return err
+		}
+
+		if len(status.(map[string]CaptureStatus)) != 0 {
+			return fmt.Errorf("expected no running capture, got %v", status)
+		}
+
+		if c.running() || c.file != nil {
+			return fmt.Errorf("expected the packet socket and the file to be closed")
+		}
+
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		if len(data) != pcapHeaderLen+pcapRecordHdrLen+60 {
+			return fmt.Errorf("expected a pcap file with a frame, got %d bytes", len(data))
+		}
+
+		if _, err := cp.handleStop(httptest.NewRequest("POST", "/network/capture/stop?interface=eth0", nil)); err == nil {
+			return fmt.Errorf("expected an error stopping the capture twice")
+		}
+
+		return nil
+	})
+
+	if errors.Is(err, errNoNamespace) {
+		t.Skip(err)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sendFrame sends a broadcast frame of the minimum length through an interface
+func sendFrame(name string) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	frame := make([]byte, 60)
+	copy(frame, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	copy(frame[6:], iface.HardwareAddr)
+	frame[12], frame[13] = 0x88, 0xb5
+
+	return unix.Sendto(fd, frame, 0, &unix.SockaddrLinklayer{Ifindex: iface.Index, Halen: 6})
+}
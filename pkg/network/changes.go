@@ -0,0 +1,81 @@
+/*
+
+Copyright 2020 Salvatore Mazzarino
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Changes records the changes made to the network of the container, so
+// that it can be restored once the guest is gone
+type Changes struct {
+	lock  sync.Mutex
+	steps []change
+}
+
+type change struct {
+	description string
+	revert      func() error
+}
+
+// record adds a change along with the function reverting it
+func (c *Changes) record(description string, revert func() error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.steps = append(c.steps, change{
+		description: description,
+		revert:      revert,
+	})
+}
+
+// merge adds the changes recorded by another Changes
+func (c *Changes) merge(other *Changes) {
+	other.lock.Lock()
+	steps := other.steps
+	other.steps = nil
+	other.lock.Unlock()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.steps = append(c.steps, steps...)
+}
+
+// Revert reverts the changes in the reverse order in which they were made.
+// The changes which cannot be reverted are logged and skipped, so that as
+// much as possible of the network of the container is restored.
+func (c *Changes) Revert() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for i := len(c.steps) - 1; i >= 0; i-- {
+		step := c.steps[i]
+
+		if err := step.revert(); err != nil {
+			log.Errorf("Failed to revert %s: %v", step.description, err)
+			continue
+		}
+
+		log.Debugf("Reverted %s", step.description)
+	}
+
+	c.steps = nil
+}
@@ -18,7 +18,9 @@ limitations under the License.
 package network
 
 import (
+	"encoding/binary"
 	"fmt"
+	"math"
 	"net"
 	"time"
 
@@ -31,26 +33,71 @@ import (
 	"github.com/giantswarm/containervmm/pkg/api"
 )
 
-var leaseDuration, _ = time.ParseDuration("4294967295s") // Infinite lease time
+// lease time encoded as 0xffffffff, which is an infinite lease, see RFC 2131 section 3.3
+const infiniteLease = math.MaxUint32 * time.Second
+
+// DHCPConfig configures the DHCP servers
+type DHCPConfig struct {
+	// LeaseTime is the duration of the leases of the IPv4 addresses. If
+	// zero, the leases are infinite.
+	LeaseTime time.Duration
+
+	// StateDir is the directory where the leases are persisted
+	StateDir string
+
+	// SearchDomains are the DNS search domains of the guest
+	SearchDomains []string
+
+	// Options are extra DHCP options, sent whether the guest requests
+	// them or not
+	Options []dhcp.Option
+}
 
 // DHCPInterface describes the NIC of container
 type DHCPInterface struct {
-	VMIPNet    *net.IPNet
-	GatewayIP  *net.IP
-	Routes     []netlink.Route
-	VMTAP      string
-	Bridge     string
-	Hostname   string
-	MACFilter  string
-	dnsServers []byte
-	ntpServers []byte
+	VMIPNet      *net.IPNet
+	GatewayIP    *net.IP
+	Routes       []netlink.Route
+	VMIPv6Net    *net.IPNet
+	GatewayIPv6  *net.IP
+	RoutesV6     []netlink.Route
+	VMTAP        string
+	Bridge       string
+	Hostname     string
+	MACFilter    string
+	MTU          int
+	LeaseTime    time.Duration
+	leases       *leaseStore
+	dnsServers   []byte
+	dnsServersV6 []net.IP
+	ntpServers   []byte
+
+	domainName     []byte
+	domainSearch   []byte
+	domainSearchV6 []byte
+	extraOptions   []dhcp.Option
 }
 
-func StartDHCPServers(guest api.Guest, dhcpIfaces []DHCPInterface, dnsServers []string, ntpServers []string) error {
+// DNSServers returns the DNS servers given by the user, or the ones given to
+// the container when there are none
+func DNSServers(dnsServers []string) ([]string, error) {
+	if len(dnsServers) > 0 {
+		return dnsServers, nil
+	}
+
 	// Fetch the DNS servers given to the container
-	containerConfig, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	containerConfig, err := dns.ClientConfigFromFile(resolvConfPath)
 	if err != nil {
-		return fmt.Errorf("failed to get DNS configuration: %v", err)
+		return nil, fmt.Errorf("failed to get DNS configuration: %v", err)
+	}
+
+	return containerConfig.Servers, nil
+}
+
+func StartDHCPServers(guest api.Guest, dhcpIfaces []DHCPInterface, dnsServers []string, ntpServers []string, config DHCPConfig) error {
+	dnsServers, err := DNSServers(dnsServers)
+	if err != nil {
+		return err
 	}
 
 	for i := range dhcpIfaces {
@@ -59,69 +106,234 @@ func StartDHCPServers(guest api.Guest, dhcpIfaces []DHCPInterface, dnsServers []
 		// Set the VM hostname to the VM ID
 		dhcpIface.Hostname = guest.Name
 
-		if len(dnsServers) > 0 {
-			// add the DNS servers from the user input
-			dhcpIface.SetDNSServers(dnsServers)
-		} else {
-			// Add the DNS servers from the container
-			dhcpIface.SetDNSServers(containerConfig.Servers)
-		}
+		dhcpIface.SetDNSServers(dnsServers)
+		dhcpIface.SetSearchDomains(config.SearchDomains)
+		dhcpIface.extraOptions = config.Options
 
 		if len(ntpServers) > 0 {
 			dhcpIface.SetNTPServers(ntpServers)
 		}
 
-		go func() {
-			log.Infof("Starting DHCP server for interface %q (%s)\n", dhcpIface.Bridge, dhcpIface.VMIPNet.IP)
+		if dhcpIface.VMIPNet != nil {
+			dhcpIface.LeaseTime = config.LeaseTime
 
-			if err := dhcpIface.StartBlockingServer(); err != nil {
-				log.Errorf("%q DHCP server error: %v\n", dhcpIface.Bridge, err)
+			if dhcpIface.leases, err = loadLeaseStore(config.StateDir, dhcpIface.Bridge, dhcpIface.MACFilter, dhcpIface.VMIPNet.IP); err != nil {
+				return err
 			}
-		}()
+
+			go func() {
+				log.Infof("Starting DHCP server for interface %q (%s)\n", dhcpIface.Bridge, dhcpIface.VMIPNet.IP)
+
+				if err := dhcpIface.StartBlockingServer(); err != nil {
+					log.Errorf("%q DHCP server error: %v\n", dhcpIface.Bridge, err)
+				}
+			}()
+		}
+
+		if dhcpIface.VMIPv6Net != nil {
+			go func() {
+				log.Infof("Starting DHCPv6 server for interface %q (%s)\n", dhcpIface.Bridge, dhcpIface.VMIPv6Net.IP)
+
+				if err := dhcpIface.StartBlockingServerV6(); err != nil {
+					log.Errorf("%q DHCPv6 server error: %v\n", dhcpIface.Bridge, err)
+				}
+			}()
+
+			go func() {
+				log.Infof("Starting router advertisements for interface %q\n", dhcpIface.Bridge)
+
+				if err := dhcpIface.StartRouterAdvertisements(); err != nil {
+					log.Errorf("%q router advertisements error: %v\n", dhcpIface.Bridge, err)
+				}
+			}()
+		}
 	}
 
 	return nil
 }
 
-// ServeDHCP responds to a DHCP request
+// ServeDHCP responds to a DHCP request of the guest, following the states
+// of the client described in RFC 2131
 func (i *DHCPInterface) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options) dhcp.Packet {
-	var respMsg dhcp.MessageType
+	mac := p.CHAddr().String()
+	if mac != i.MACFilter {
+		return nil
+	}
+
+	serverID := i.serverIdentifier()
 
 	switch msgType {
 	case dhcp.Discover:
-		respMsg = dhcp.Offer
+		return i.reply(p, dhcp.Offer, i.VMIPNet.IP, options)
 	case dhcp.Request:
-		respMsg = dhcp.ACK
-	}
+		id, selecting := options[dhcp.OptionServerIdentifier]
+		if selecting && !net.IP(id).Equal(serverID) {
+			// the guest selected the offer of another server
+			log.Debugf("%q DHCP request for server %s, ignoring", i.Bridge, net.IP(id))
+			return nil
+		}
 
-	if respMsg != 0 {
-		requestingMAC := p.CHAddr().String()
+		// the address is requested when selecting an offer and when
+		// rebooting, it is the address of the client when renewing
+		// and rebinding
+		requested := net.IP(options[dhcp.OptionRequestedIPAddress])
+		if requested == nil {
+			requested = p.CIAddr()
+		}
 
-		if requestingMAC == i.MACFilter {
-			opts := dhcp.Options{
-				dhcp.OptionSubnetMask:       []byte(i.VMIPNet.Mask),
-				dhcp.OptionRouter:           []byte(*i.GatewayIP),
-				dhcp.OptionDomainNameServer: i.dnsServers,
-				dhcp.OptionHostName:         []byte(i.Hostname),
-			}
+		if !requested.Equal(i.VMIPNet.IP) {
+			log.Warningf("%q DHCP request for address %s instead of %s, sending NAK", i.Bridge, requested, i.VMIPNet.IP)
+			return dhcp.ReplyPacket(p, dhcp.NAK, serverID, nil, 0, nil)
+		}
 
-			if netRoutes := formClasslessRoutes(&i.Routes); netRoutes != nil {
-				opts[dhcp.OptionClasslessRouteFormat] = netRoutes
+		// the guest rebooting, renewing or rebinding asks for the lease
+		// it holds, which is extended only if it is still valid, see RFC
+		// 2131 section 4.3.2
+		if !selecting && !i.leases.valid(mac, i.VMIPNet.IP) {
+			if p.CIAddr().IsUnspecified() {
+				// the server has no record of the rebooting guest, which
+				// starts over once its request times out
+				log.Infof("%q DHCP request of rebooting guest without lease, ignoring", i.Bridge)
+				return nil
 			}
 
-			if i.ntpServers != nil {
-				opts[dhcp.OptionNetworkTimeProtocolServers] = i.ntpServers
-			}
+			log.Warningf("%q DHCP request to extend an expired lease, sending NAK", i.Bridge)
+			return dhcp.ReplyPacket(p, dhcp.NAK, serverID, nil, 0, nil)
+		}
 
-			optSlice := opts.SelectOrderOrAll(options[dhcp.OptionParameterRequestList])
+		if err := i.leases.grant(mac, i.VMIPNet.IP, i.LeaseTime); err != nil {
+			log.Errorf("%q failed to persist DHCP lease: %v", i.Bridge, err)
+		}
+
+		return i.reply(p, dhcp.ACK, i.VMIPNet.IP, options)
+	case dhcp.Inform:
+		// the guest configured its address itself, it only gets the options
+		return i.reply(p, dhcp.ACK, nil, options)
+	case dhcp.Decline:
+		log.Errorf("%q guest declined address %s, which is in use by another host on the link",
+			i.Bridge, net.IP(options[dhcp.OptionRequestedIPAddress]))
 
-			return dhcp.ReplyPacket(p, respMsg, *i.GatewayIP, i.VMIPNet.IP, leaseDuration, optSlice)
+		if err := i.leases.release(); err != nil {
+			log.Errorf("%q failed to drop DHCP lease: %v", i.Bridge, err)
+		}
+	case dhcp.Release:
+		log.Infof("%q guest released address %s", i.Bridge, p.CIAddr())
+
+		if err := i.leases.release(); err != nil {
+			log.Errorf("%q failed to drop DHCP lease: %v", i.Bridge, err)
 		}
 	}
 
 	return nil
 }
 
+// reply builds the reply to the guest, leasing the given address. The
+// replies to DHCPINFORM carry no address and no lease, see RFC 2131
+// section 4.3.5.
+func (i *DHCPInterface) reply(p dhcp.Packet, msgType dhcp.MessageType, yIAddr net.IP, options dhcp.Options) dhcp.Packet {
+	opts := dhcp.Options{
+		dhcp.OptionSubnetMask:       []byte(i.VMIPNet.Mask),
+		dhcp.OptionDomainNameServer: i.dnsServers,
+		dhcp.OptionHostName:         []byte(i.Hostname),
+	}
+
+	// the networks without gateway are only reachable on-link
+	if i.GatewayIP != nil {
+		opts[dhcp.OptionRouter] = []byte(i.GatewayIP.To4())
+	}
+
+	if netRoutes := formClasslessRoutes(&i.Routes); netRoutes != nil {
+		opts[dhcp.OptionClasslessRouteFormat] = netRoutes
+	}
+
+	if i.ntpServers != nil {
+		opts[dhcp.OptionNetworkTimeProtocolServers] = i.ntpServers
+	}
+
+	if i.MTU > 0 {
+		opts[dhcp.OptionInterfaceMTU] = mtuOption(i.MTU)
+	}
+
+	if len(i.domainName) > 0 {
+		opts[dhcp.OptionDomainName] = i.domainName
+		opts[dhcpOptionDomainSearch] = i.domainSearch
+	}
+
+	// the extra options override the ones above
+	for _, option := range i.extraOptions {
+		opts[option.Code] = option.Value
+	}
+
+	optSlice := opts.SelectOrderOrAll(options[dhcp.OptionParameterRequestList])
+
+	// the extra options are sent even when the guest does not request them
+	for _, option := range i.extraOptions {
+		if !hasOption(optSlice, option.Code) {
+			optSlice = append(optSlice, option)
+		}
+	}
+
+	if yIAddr == nil {
+		return dhcp.ReplyPacket(p, msgType, i.serverIdentifier(), nil, 0, optSlice)
+	}
+
+	if i.LeaseTime == 0 {
+		// the guest never renews an infinite lease
+		return dhcp.ReplyPacket(p, msgType, i.serverIdentifier(), yIAddr, infiniteLease, optSlice)
+	}
+
+	// the guest renews its lease at T1 and rebinds it at T2, the RFC
+	// defaults being half and seven eighths of the lease time
+	optSlice = append(optSlice,
+		dhcp.Option{Code: dhcp.OptionRenewalTimeValue, Value: leaseSeconds(i.LeaseTime / 2)},
+		dhcp.Option{Code: dhcp.OptionRebindingTimeValue, Value: leaseSeconds(i.LeaseTime * 7 / 8)},
+	)
+
+	return dhcp.ReplyPacket(p, msgType, i.serverIdentifier(), yIAddr, i.LeaseTime, optSlice)
+}
+
+func hasOption(options []dhcp.Option, code dhcp.OptionCode) bool {
+	for _, option := range options {
+		if option.Code == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+// leaseSeconds encodes a duration of the lease in seconds
+func leaseSeconds(d time.Duration) []byte {
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, uint32(d/time.Second))
+
+	return value
+}
+
+// serverIdentifier returns the address identifying the DHCP server, which is the gateway when there is one.
+// Otherwise, it is the first address of the subnet other than the one of the guest. The server does not own
+// the address, so that the renewals the guest unicasts to it with a finite lease time are not answered.
+func (i *DHCPInterface) serverIdentifier() net.IP {
+	if i.GatewayIP != nil {
+		return i.GatewayIP.To4()
+	}
+
+	network := i.VMIPNet.IP.To4().Mask(i.VMIPNet.Mask)
+	ones, bits := i.VMIPNet.Mask.Size()
+
+	for host := uint32(1); host < 3 && bits-ones > 1; host++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(network)+host)
+
+		if !ip.Equal(i.VMIPNet.IP) {
+			return ip
+		}
+	}
+
+	// there is no other address in the subnet
+	return i.VMIPNet.IP.To4()
+}
+
 // StartBlockingServer starts a blocking DHCP server on port 67
 func (i *DHCPInterface) StartBlockingServer() error {
 	packetConn, err := conn.NewUDP4BoundListener(i.Bridge, ":67")
@@ -132,10 +344,19 @@ func (i *DHCPInterface) StartBlockingServer() error {
 	return dhcp.Serve(packetConn, i)
 }
 
-// Parse the DNS servers for the DHCP server
+// Parse the DNS servers for the DHCP servers, the IPv6 ones are served by DHCPv6
 func (i *DHCPInterface) SetDNSServers(dns []string) {
 	for _, server := range dns {
-		i.dnsServers = append(i.dnsServers, []byte(net.ParseIP(server).To4())...)
+		ip := net.ParseIP(server)
+		if ip == nil {
+			continue
+		}
+
+		if ip.To4() != nil {
+			i.dnsServers = append(i.dnsServers, []byte(ip.To4())...)
+		} else {
+			i.dnsServersV6 = append(i.dnsServersV6, ip)
+		}
 	}
 }
 
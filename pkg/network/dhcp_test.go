@@ -0,0 +1,327 @@
+/*
+
+Copyright 2020 Salvatore Mazzarino
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+var (
+	testGuestMAC = net.HardwareAddr{0x02, 0x42, 0xac, 0x11, 0x00, 0x02}
+	testOtherMAC = net.HardwareAddr{0x02, 0x42, 0xac, 0x11, 0x00, 0x03}
+
+	testGuestIP = net.IPv4(10, 0, 0, 2).To4()
+	testOtherIP = net.IPv4(10, 0, 0, 3).To4()
+	testGateway = net.IPv4(10, 0, 0, 1).To4()
+)
+
+func newTestDHCPInterface(t *testing.T, leaseTime time.Duration) *DHCPInterface {
+	leases, err := loadLeaseStore(t.TempDir(), "br-eth0", testGuestMAC.String(), testGuestIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gateway := net.IP(testGateway)
+
+	return &DHCPInterface{
+		VMIPNet:   &net.IPNet{IP: testGuestIP, Mask: net.CIDRMask(24, 32)},
+		GatewayIP: &gateway,
+		Bridge:    "br-eth0",
+		Hostname:  "guest",
+		MACFilter: testGuestMAC.String(),
+		LeaseTime: leaseTime,
+		leases:    leases,
+	}
+}
+
+func TestServeDHCP(t *testing.T) {
+	testCases := []struct {
+		name      string
+		leaseTime time.Duration
+
+		// the guest holds a lease before the request
+		leased bool
+
+		msgType dhcp.MessageType
+		mac     net.HardwareAddr
+		ciaddr  net.IP
+		options []dhcp.Option
+
+		// expected reply, zero for no reply
+		reply    dhcp.MessageType
+		yiaddr   net.IP
+		lease    uint32
+		renewal  bool
+		leasedAt bool
+	}{
+		{
+			name:    "discover",
+			msgType: dhcp.Discover,
+			reply:   dhcp.Offer,
+			yiaddr:  testGuestIP,
+			lease:   0xffffffff,
+		},
+		{
+			name:    "discover of another client",
+			msgType: dhcp.Discover,
+			mac:     testOtherMAC,
+		},
+		{
+			name:    "request selecting the offer",
+			msgType: dhcp.Request,
+			options: []dhcp.Option{
+				{Code: dhcp.OptionServerIdentifier, Value: testGateway},
+				{Code: dhcp.OptionRequestedIPAddress, Value: testGuestIP},
+			},
+			reply:    dhcp.ACK,
+			yiaddr:   testGuestIP,
+			lease:    0xffffffff,
+			leasedAt: true,
+		},
+		{
+			name:      "request selecting the offer with a finite lease",
+			leaseTime: time.Hour,
+			msgType:   dhcp.Request,
+			options: []dhcp.Option{
+				{Code: dhcp.OptionServerIdentifier, Value: testGateway},
+				{Code: dhcp.OptionRequestedIPAddress, Value: testGuestIP},
+			},
+			reply:    dhcp.ACK,
+			yiaddr:   testGuestIP,
+			lease:    3600,
+			renewal:  true,
+			leasedAt: true,
+		},
+		{
+			name:    "request selecting the offer of another server",
+			msgType: dhcp.Request,
+			options: []dhcp.Option{
+				{Code: dhcp.OptionServerIdentifier, Value: net.IPv4(10, 0, 0, 254).To4()},
+				{Code: dhcp.OptionRequestedIPAddress, Value: testGuestIP},
+			},
+		},
+		{
+			name:    "request for another address",
+			msgType: dhcp.Request,
+			options: []dhcp.Option{
+				{Code: dhcp.OptionServerIdentifier, Value: testGateway},
+				{Code: dhcp.OptionRequestedIPAddress, Value: testOtherIP},
+			},
+			reply: dhcp.NAK,
+		},
+		{
+			name:    "init-reboot with a lease",
+			leased:  true,
+			msgType: dhcp.Request,
+			options: []dhcp.Option{
+				{Code: dhcp.OptionRequestedIPAddress, Value: testGuestIP},
+			},
+			reply:    dhcp.ACK,
+			yiaddr:   testGuestIP,
+			lease:    0xffffffff,
+			leasedAt: true,
+		},
+		{
+			name:    "init-reboot without lease",
+			msgType: dhcp.Request,
+			options: []dhcp.Option{
+				{Code: dhcp.OptionRequestedIPAddress, Value: testGuestIP},
+			},
+		},
+		{
+			name:    "init-reboot for another address",
+			leased:  true,
+			msgType: dhcp.Request,
+			options: []dhcp.Option{
+				{Code: dhcp.OptionRequestedIPAddress, Value: testOtherIP},
+			},
+			reply:    dhcp.NAK,
+			leasedAt: true,
+		},
+		{
+			name:      "renew",
+			leaseTime: time.Hour,
+			leased:    true,
+			msgType:   dhcp.Request,
+			ciaddr:    testGuestIP,
+			reply:     dhcp.ACK,
+			yiaddr:    testGuestIP,
+			lease:     3600,
+			renewal:   true,
+			leasedAt:  true,
+		},
+		{
+			name:      "renew without lease",
+			leaseTime: time.Hour,
+			msgType:   dhcp.Request,
+			ciaddr:    testGuestIP,
+			reply:     dhcp.NAK,
+		},
+		{
+			name:    "inform",
+			msgType: dhcp.Inform,
+			ciaddr:  testGuestIP,
+			reply:   dhcp.ACK,
+			yiaddr:  net.IPv4zero.To4(),
+		},
+		{
+			name:    "release",
+			leased:  true,
+			msgType: dhcp.Release,
+			ciaddr:  testGuestIP,
+		},
+		{
+			name:    "decline",
+			leased:  true,
+			msgType: dhcp.Decline,
+			options: []dhcp.Option{
+				{Code: dhcp.OptionRequestedIPAddress, Value: testGuestIP},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			i := newTestDHCPInterface(t, tc.leaseTime)
+
+			if tc.leased {
+				if err := i.leases.grant(testGuestMAC.String(), testGuestIP, tc.leaseTime); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			mac := tc.mac
+			if mac == nil {
+				mac = testGuestMAC
+			}
+
+			ciaddr := tc.ciaddr
+			if ciaddr == nil {
+				ciaddr = net.IPv4zero
+			}
+
+			req := dhcp.RequestPacket(tc.msgType, mac, ciaddr, []byte{1, 2, 3, 4}, false, tc.options)
+			options := req.ParseOptions()
+
+			resp := i.ServeDHCP(req, tc.msgType, options)
+
+			if leased := i.leases.valid(testGuestMAC.String(), testGuestIP); leased != tc.leasedAt {
+				t.Errorf("expected the guest to hold a lease %t, got %t", tc.leasedAt, leased)
+			}
+
+			if tc.reply == 0 {
+				if resp != nil {
+					t.Fatalf("expected no reply, got %v", dhcp.MessageType(resp.ParseOptions()[dhcp.OptionDHCPMessageType][0]))
+				}
+
+				return
+			}
+
+			if resp == nil {
+				t.Fatalf("expected %v, got no reply", tc.reply)
+			}
+
+			respOptions := resp.ParseOptions()
+
+			if msgType := dhcp.MessageType(respOptions[dhcp.OptionDHCPMessageType][0]); msgType != tc.reply {
+				t.Fatalf("expected %v, got %v", tc.reply, msgType)
+			}
+
+			if id := net.IP(respOptions[dhcp.OptionServerIdentifier]); !id.Equal(testGateway) {
+				t.Errorf("expected server identifier %s, got %s", net.IP(testGateway), id)
+			}
+
+			if tc.reply == dhcp.NAK {
+				return
+			}
+
+			if !resp.YIAddr().Equal(tc.yiaddr) {
+				t.Errorf("expected address %s, got %s", tc.yiaddr, resp.YIAddr())
+			}
+
+			var lease uint32
+			if value, ok := respOptions[dhcp.OptionIPAddressLeaseTime]; ok {
+				lease = binary.BigEndian.Uint32(value)
+			}
+
+			if lease != tc.lease {
+				t.Errorf("expected lease time %d, got %d", tc.lease, lease)
+			}
+
+			if _, renewal := respOptions[dhcp.OptionRenewalTimeValue]; renewal != tc.renewal {
+				t.Errorf("expected renewal time %t, got %t", tc.renewal, renewal)
+			}
+		})
+	}
+}
+
+func TestServerIdentifier(t *testing.T) {
+	testCases := []struct {
+		name    string
+		ip      string
+		gateway string
+		want    string
+	}{
+		{
+			name:    "gateway",
+			ip:      "10.0.0.2/24",
+			gateway: "169.254.1.1",
+			want:    "169.254.1.1",
+		},
+		{
+			name: "first address of the subnet",
+			ip:   "10.0.0.5/24",
+			want: "10.0.0.1",
+		},
+		{
+			name: "guest on the first address of the subnet",
+			ip:   "10.0.0.1/24",
+			want: "10.0.0.2",
+		},
+		{
+			name: "point-to-point subnet",
+			ip:   "10.0.0.1/31",
+			want: "10.0.0.1",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ip, ipNet, err := net.ParseCIDR(tc.ip)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			i := &DHCPInterface{VMIPNet: &net.IPNet{IP: ip, Mask: ipNet.Mask}}
+
+			if tc.gateway != "" {
+				gateway := net.ParseIP(tc.gateway)
+				i.GatewayIP = &gateway
+			}
+
+			if id := i.serverIdentifier(); !id.Equal(net.ParseIP(tc.want)) {
+				t.Errorf("expected %s, got %s", tc.want, id)
+			}
+		})
+	}
+}
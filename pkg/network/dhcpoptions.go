@@ -0,0 +1,147 @@
+/*
+
+Copyright 2020 Salvatore Mazzarino
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	resolvConfPath = "/etc/resolv.conf"
+
+	// the domain search option, see RFC 3397
+	dhcpOptionDomainSearch dhcp.OptionCode = 119
+
+	// a DHCP option holds at most 255 bytes
+	dhcpOptionMaxLength = 255
+)
+
+// DNSSearchDomains returns the search domains given to the container, such as the domains of the
+// Kubernetes services
+func DNSSearchDomains() ([]string, error) {
+	containerConfig, err := dns.ClientConfigFromFile(resolvConfPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get DNS configuration: %v", err)
+	}
+
+	return containerConfig.Search, nil
+}
+
+// ParseDHCPOptions parses the extra DHCP options given as "code:value". The value is either bytes in
+// hexadecimal prefixed by 0x, a comma-separated list of IPv4 addresses or a string
+// (i.e. "42:10.0.0.1,10.0.0.2", "252:http://wpad/wpad.dat", "43:0x0104c0a80001").
+func ParseDHCPOptions(inputs []string) ([]dhcp.Option, error) {
+	var options []dhcp.Option
+
+	for _, input := range inputs {
+		s := strings.SplitN(input, ":", 2)
+		if len(s) != 2 {
+			return nil, fmt.Errorf("invalid DHCP option %q, expected format is code:value", input)
+		}
+
+		code, err := strconv.ParseUint(s[0], 10, 8)
+		if err != nil || code == 0 || code == 255 {
+			return nil, fmt.Errorf("invalid DHCP option code %q", s[0])
+		}
+
+		value, err := parseDHCPOptionValue(s[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of DHCP option %d: %v", code, err)
+		}
+
+		if len(value) > dhcpOptionMaxLength {
+			return nil, fmt.Errorf("value of DHCP option %d is longer than %d bytes", code, dhcpOptionMaxLength)
+		}
+
+		options = append(options, dhcp.Option{
+			Code:  dhcp.OptionCode(code),
+			Value: value,
+		})
+	}
+
+	return options, nil
+}
+
+func parseDHCPOptionValue(input string) ([]byte, error) {
+	if strings.HasPrefix(input, "0x") {
+		return hex.DecodeString(input[2:])
+	}
+
+	var addresses []byte
+	for _, address := range strings.Split(input, ",") {
+		ip := net.ParseIP(address).To4()
+		if ip == nil {
+			// not a list of addresses
+			return []byte(input), nil
+		}
+
+		addresses = append(addresses, ip...)
+	}
+
+	return addresses, nil
+}
+
+// SetSearchDomains sets the domain name and the search domains served to the guest. The domain name is
+// the first search domain.
+func (i *DHCPInterface) SetSearchDomains(domains []string) {
+	if len(domains) == 0 {
+		return
+	}
+
+	i.domainName = []byte(strings.TrimSuffix(domains[0], "."))
+	i.domainSearch = encodeDomainSearch(domains, true)
+	i.domainSearchV6 = encodeDomainSearch(domains, false)
+}
+
+// encodeDomainSearch encodes the search domains as a sequence of DNS names. DHCP compresses the names
+// as DNS messages do, while DHCPv6 does not, see RFC 3397 and RFC 3646. The domains which do not fit
+// in a DHCP option are left out.
+func encodeDomainSearch(domains []string, compress bool) []byte {
+	buffer := make([]byte, dhcpOptionMaxLength)
+	compression := map[string]int{}
+	off := 0
+
+	for _, domain := range domains {
+		next, err := dns.PackDomainName(dns.Fqdn(domain), buffer, off, compression, compress)
+		if err != nil {
+			log.Warningf("Leaving search domain %q and the following ones out of DHCP: %v", domain, err)
+			break
+		}
+
+		off = next
+	}
+
+	return buffer[:off]
+}
+
+// mtuOption encodes the MTU of the interface
+func mtuOption(mtu int) []byte {
+	value := make([]byte, 2)
+	binary.BigEndian.PutUint16(value, uint16(mtu))
+
+	return value
+}
@@ -0,0 +1,197 @@
+/*
+
+Copyright 2020 Salvatore Mazzarino
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"bytes"
+	"testing"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+func TestParseDHCPOptions(t *testing.T) {
+	testCases := []struct {
+		name    string
+		inputs  []string
+		want    []dhcp.Option
+		wantErr bool
+	}{
+		{
+			name:   "hexadecimal",
+			inputs: []string{"43:0x0104c0a80001"},
+			want: []dhcp.Option{
+				{Code: 43, Value: []byte{0x01, 0x04, 0xc0, 0xa8, 0x00, 0x01}},
+			},
+		},
+		{
+			name:   "addresses",
+			inputs: []string{"42:10.0.0.1,10.0.0.2"},
+			want: []dhcp.Option{
+				{Code: 42, Value: []byte{10, 0, 0, 1, 10, 0, 0, 2}},
+			},
+		},
+		{
+			name:   "string",
+			inputs: []string{"252:http://wpad/wpad.dat"},
+			want: []dhcp.Option{
+				{Code: 252, Value: []byte("http://wpad/wpad.dat")},
+			},
+		},
+		{
+			name:   "string with an address",
+			inputs: []string{"66:10.0.0.1,tftp"},
+			want: []dhcp.Option{
+				{Code: 66, Value: []byte("10.0.0.1,tftp")},
+			},
+		},
+		{
+			name:   "several options",
+			inputs: []string{"42:10.0.0.1", "66:tftp"},
+			want: []dhcp.Option{
+				{Code: 42, Value: []byte{10, 0, 0, 1}},
+				{Code: 66, Value: []byte("tftp")},
+			},
+		},
+		{
+			name: "no option",
+		},
+		{
+			name:    "missing value",
+			inputs:  []string{"42"},
+			wantErr: true,
+		},
+		{
+			name:    "pad code",
+			inputs:  []string{"0:foo"},
+			wantErr: true,
+		},
+		{
+			name:    "end code",
+			inputs:  []string{"255:foo"},
+			wantErr: true,
+		},
+		{
+			name:    "code out of range",
+			inputs:  []string{"256:foo"},
+			wantErr: true,
+		},
+		{
+			name:    "code not a number",
+			inputs:  []string{"ntp:10.0.0.1"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid hexadecimal",
+			inputs:  []string{"43:0x0g"},
+			wantErr: true,
+		},
+		{
+			name:    "value too long",
+			inputs:  []string{"252:" + string(bytes.Repeat([]byte("a"), 256))},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			options, err := ParseDHCPOptions(tc.inputs)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", options)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(options) != len(tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, options)
+			}
+
+			for i := range options {
+				if options[i].Code != tc.want[i].Code || !bytes.Equal(options[i].Value, tc.want[i].Value) {
+					t.Errorf("expected %v, got %v", tc.want[i], options[i])
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeDomainSearch(t *testing.T) {
+	testCases := []struct {
+		name     string
+		domains  []string
+		compress bool
+		want     []byte
+	}{
+		{
+			// example of RFC 3397 section 3
+			name:     "compressed",
+			domains:  []string{"eng.apple.com", "marketing.apple.com"},
+			compress: true,
+			want: []byte("\x03eng\x05apple\x03com\x00" +
+				"\x09marketing\xc0\x04"),
+		},
+		{
+			name:    "uncompressed",
+			domains: []string{"eng.apple.com", "marketing.apple.com"},
+			want: []byte("\x03eng\x05apple\x03com\x00" +
+				"\x09marketing\x05apple\x03com\x00"),
+		},
+		{
+			name:     "fully qualified",
+			domains:  []string{"eng.apple.com.", "apple.com."},
+			compress: true,
+			want: []byte("\x03eng\x05apple\x03com\x00" +
+				"\xc0\x04"),
+		},
+		{
+			name:     "kubernetes",
+			domains:  []string{"default.svc.cluster.local", "svc.cluster.local", "cluster.local"},
+			compress: true,
+			want: []byte("\x07default\x03svc\x07cluster\x05local\x00" +
+				"\xc0\x08" +
+				"\xc0\x0c"),
+		},
+		{
+			name: "no domain",
+			want: []byte{},
+		},
+		{
+			name: "domains over 255 bytes",
+			domains: []string{
+				string(bytes.Repeat([]byte("a"), 63)) + "." + string(bytes.Repeat([]byte("b"), 63)) + ".com",
+				string(bytes.Repeat([]byte("c"), 63)) + "." + string(bytes.Repeat([]byte("d"), 63)) + ".com",
+			},
+			want: append(append(append([]byte{63}, bytes.Repeat([]byte("a"), 63)...),
+				append([]byte{63}, bytes.Repeat([]byte("b"), 63)...)...),
+				[]byte("\x03com\x00")...),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if encoded := encodeDomainSearch(tc.domains, tc.compress); !bytes.Equal(encoded, tc.want) {
+				t.Errorf("expected %q, got %q", tc.want, encoded)
+			}
+		})
+	}
+}
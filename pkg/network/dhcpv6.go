@@ -0,0 +1,412 @@
+/*
+
+Copyright 2020 Salvatore Mazzarino
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+// DHCPv6 message types, see RFC 8415
+const (
+	dhcpv6Solicit            = 1
+	dhcpv6Advertise          = 2
+	dhcpv6Request            = 3
+	dhcpv6Confirm            = 4
+	dhcpv6Renew              = 5
+	dhcpv6Rebind             = 6
+	dhcpv6Reply              = 7
+	dhcpv6Release            = 8
+	dhcpv6Decline            = 9
+	dhcpv6InformationRequest = 11
+)
+
+// DHCPv6 options
+const (
+	dhcpv6OptionClientID    = 1
+	dhcpv6OptionServerID    = 2
+	dhcpv6OptionIANA        = 3
+	dhcpv6OptionIAAddr      = 5
+	dhcpv6OptionStatusCode  = 13
+	dhcpv6OptionRapidCommit = 14
+	dhcpv6OptionDNSServers  = 23
+	dhcpv6OptionDomainList  = 24
+)
+
+const (
+	dhcpv6ServerPort = 547
+
+	// bridge table of the rules keeping the DHCPv6 servers and the router
+	// advertisements to the guest
+	ipv6IsolationTableName = "containervmm-ipv6"
+
+	// lifetime of the addresses and renewal times of the leases, the
+	// address of the guest never changes
+	dhcpv6Infinity = 0xffffffff
+
+	dhcpv6StatusSuccess = 0
+)
+
+// the multicast group the DHCPv6 clients send their requests to
+var allDHCPRelayAgentsAndServers = net.ParseIP("ff02::1:2")
+
+type dhcpv6Option struct {
+	code uint16
+	data []byte
+}
+
+type dhcpv6Options []dhcpv6Option
+
+// get returns the data of the first option with the given code
+func (opts dhcpv6Options) get(code uint16) ([]byte, bool) {
+	for _, opt := range opts {
+		if opt.code == code {
+			return opt.data, true
+		}
+	}
+
+	return nil, false
+}
+
+// StartBlockingServerV6 starts a blocking DHCPv6 server on port 547
+func (i *DHCPInterface) StartBlockingServerV6() error {
+	bridge, err := net.InterfaceByName(i.Bridge)
+	if err != nil {
+		return err
+	}
+
+	// the servers of all the bridges listen on the same port
+	lc := net.ListenConfig{
+		Control: bindToDevice(i.Bridge),
+	}
+
+	packetConn, err := lc.ListenPacket(context.Background(), "udp6", fmt.Sprintf("[::]:%d", dhcpv6ServerPort))
+	if err != nil {
+		return err
+	}
+	defer packetConn.Close()
+
+	if err := ipv6.NewPacketConn(packetConn).JoinGroup(bridge, &net.UDPAddr{IP: allDHCPRelayAgentsAndServers}); err != nil {
+		return fmt.Errorf("failed to join DHCPv6 multicast group: %v", err)
+	}
+
+	// DUID-LL made of the MAC address of the bridge
+	serverID := append([]byte{0, 3, 0, 1}, bridge.HardwareAddr...)
+
+	buffer := make([]byte, 1500)
+	for {
+		n, addr, err := packetConn.ReadFrom(buffer)
+		if err != nil {
+			return err
+		}
+
+		resp := i.ServeDHCPv6(buffer[:n], serverID)
+		if resp == nil {
+			continue
+		}
+
+		// the replies fail until the link-local address of the bridge
+		// is usable, the guest sends its request again
+		if _, err := packetConn.WriteTo(resp, addr); err != nil {
+			log.Warningf("%q failed to send DHCPv6 reply: %v", i.Bridge, err)
+		}
+	}
+}
+
+// ServeDHCPv6 responds to a DHCPv6 message. The requests of the other
+// clients on the bridge are dropped by the rules added by
+// addIPv6IsolationRules, so all the clients get the address of the guest.
+func (i *DHCPInterface) ServeDHCPv6(req []byte, serverID []byte) []byte {
+	if len(req) < 4 {
+		return nil
+	}
+
+	msgType := req[0]
+	transactionID := req[1:4]
+
+	opts, err := parseDHCPv6Options(req[4:])
+	if err != nil {
+		log.Debugf("%q invalid DHCPv6 message: %v", i.Bridge, err)
+		return nil
+	}
+
+	clientID, hasClientID := opts.get(dhcpv6OptionClientID)
+	if !hasClientID && msgType != dhcpv6InformationRequest {
+		return nil
+	}
+
+	// messages meant for another server are ignored
+	if id, ok := opts.get(dhcpv6OptionServerID); ok && !bytes.Equal(id, serverID) {
+		return nil
+	}
+
+	respType := byte(dhcpv6Reply)
+	_, rapidCommit := opts.get(dhcpv6OptionRapidCommit)
+
+	switch msgType {
+	case dhcpv6Solicit:
+		if !rapidCommit {
+			respType = dhcpv6Advertise
+		}
+	case dhcpv6Request, dhcpv6Confirm, dhcpv6Renew, dhcpv6Rebind,
+		dhcpv6Release, dhcpv6Decline, dhcpv6InformationRequest:
+	default:
+		return nil
+	}
+
+	resp := append([]byte{respType}, transactionID...)
+	resp = appendDHCPv6Option(resp, dhcpv6OptionServerID, serverID)
+
+	if hasClientID {
+		resp = appendDHCPv6Option(resp, dhcpv6OptionClientID, clientID)
+	}
+
+	if msgType == dhcpv6Solicit && rapidCommit {
+		resp = appendDHCPv6Option(resp, dhcpv6OptionRapidCommit, nil)
+	}
+
+	switch msgType {
+	case dhcpv6Solicit, dhcpv6Request, dhcpv6Renew, dhcpv6Rebind:
+		for _, opt := range opts {
+			if opt.code != dhcpv6OptionIANA || len(opt.data) < 12 {
+				continue
+			}
+
+			resp = appendDHCPv6Option(resp, dhcpv6OptionIANA, i.identityAssociation(opt.data[:4]))
+		}
+	case dhcpv6Confirm, dhcpv6Release, dhcpv6Decline:
+		// the address is assigned statically, there is nothing to release
+		resp = appendDHCPv6Option(resp, dhcpv6OptionStatusCode, []byte{0, dhcpv6StatusSuccess})
+	}
+
+	if len(i.dnsServersV6) > 0 {
+		var servers []byte
+		for _, server := range i.dnsServersV6 {
+			servers = append(servers, server.To16()...)
+		}
+
+		resp = appendDHCPv6Option(resp, dhcpv6OptionDNSServers, servers)
+	}
+
+	if len(i.domainSearchV6) > 0 {
+		resp = appendDHCPv6Option(resp, dhcpv6OptionDomainList, i.domainSearchV6)
+	}
+
+	return resp
+}
+
+// identityAssociation returns the IA_NA option holding the address of
+// the guest for the given IAID
+func (i *DHCPInterface) identityAssociation(iaid []byte) []byte {
+	ia := make([]byte, 12)
+	copy(ia, iaid)
+	binary.BigEndian.PutUint32(ia[4:], dhcpv6Infinity)
+	binary.BigEndian.PutUint32(ia[8:], dhcpv6Infinity)
+
+	addr := make([]byte, 24)
+	copy(addr, i.VMIPv6Net.IP.To16())
+	binary.BigEndian.PutUint32(addr[16:], dhcpv6Infinity)
+	binary.BigEndian.PutUint32(addr[20:], dhcpv6Infinity)
+
+	return appendDHCPv6Option(ia, dhcpv6OptionIAAddr, addr)
+}
+
+func parseDHCPv6Options(data []byte) (dhcpv6Options, error) {
+	var opts dhcpv6Options
+
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("truncated option header")
+		}
+
+		code := binary.BigEndian.Uint16(data[0:2])
+		length := int(binary.BigEndian.Uint16(data[2:4]))
+
+		if len(data) < 4+length {
+			return nil, fmt.Errorf("truncated option %d", code)
+		}
+
+		opts = append(opts, dhcpv6Option{
+			code: code,
+			data: data[4 : 4+length],
+		})
+
+		data = data[4+length:]
+	}
+
+	return opts, nil
+}
+
+func appendDHCPv6Option(data []byte, code uint16, value []byte) []byte {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint16(header[0:2], code)
+	binary.BigEndian.PutUint16(header[2:4], uint16(len(value)))
+
+	return append(append(data, header...), value...)
+}
+
+// bindToDevice returns a function binding a socket to the given interface
+// before its address is bound, so that the same port can be used on every
+// bridge
+func bindToDevice(ifaceName string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+
+		if ctrlErr := c.Control(func(fd uintptr) {
+			err = syscall.BindToDevice(int(fd), ifaceName)
+		}); ctrlErr != nil {
+			return ctrlErr
+		}
+
+		return err
+	}
+}
+
+// addIPv6IsolationRules keeps the DHCPv6 servers and the router advertisements to the guest. The bridges
+// connect the guest to the network of the pod, on which the advertisements sent in the name of the gateway
+// and the addresses served over DHCPv6 would reach the other hosts. The requests received by the DHCPv6
+// servers from another port of the bridge, or from another MAC address than the one of the guest, are
+// dropped, as well as the router solicitations from another port, along with the DHCPv6 replies and the
+// router advertisements sent to another port of the bridge.
+func addIPv6IsolationRules(dhcpIfaces []DHCPInterface, changes *Changes) error {
+	var ipv6Ifaces []DHCPInterface
+	for _, dhcpIface := range dhcpIfaces {
+		if dhcpIface.VMIPv6Net != nil {
+			ipv6Ifaces = append(ipv6Ifaces, dhcpIface)
+		}
+	}
+
+	if len(ipv6Ifaces) == 0 {
+		return nil
+	}
+
+	conn := &nftables.Conn{}
+
+	table := conn.AddTable(&nftables.Table{
+		Name:   ipv6IsolationTableName,
+		Family: nftables.TableFamilyBridge,
+	})
+
+	input := conn.AddChain(&nftables.Chain{
+		Name:     "input",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+	})
+
+	output := conn.AddChain(&nftables.Chain{
+		Name:     "output",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookOutput,
+		Priority: nftables.ChainPriorityFilter,
+	})
+
+	for _, dhcpIface := range ipv6Ifaces {
+		mac, err := net.ParseMAC(dhcpIface.MACFilter)
+		if err != nil {
+			return fmt.Errorf("invalid MAC address of %q: %v", dhcpIface.VMTAP, err)
+		}
+
+		// the container interface bridged with the TAP, see bridge
+		port := strings.TrimPrefix(dhcpIface.VMTAP, "tap-")
+
+		addRule := func(chain *nftables.Chain, comment string, exprs ...expr.Any) {
+			conn.AddRule(&nftables.Rule{
+				Table:    table,
+				Chain:    chain,
+				Exprs:    append(exprs, &expr.Counter{}, &expr.Verdict{Kind: expr.VerdictDrop}),
+				UserData: nftablesComment(fmt.Sprintf("%s %s", dhcpIface.Bridge, comment)),
+			})
+		}
+
+		dhcpv6Requests := matchUDPPort(2, dhcpv6ServerPort)
+
+		// iifname <port> udp dport 547 counter drop
+		addRule(input, "DHCPv6 request from the pod network",
+			append(matchInterface(expr.MetaKeyIIFNAME, port), dhcpv6Requests...)...)
+
+		// iifname <TAP> ether saddr != <MAC> udp dport 547 counter drop
+		addRule(input, "DHCPv6 request from another MAC address",
+			append(append(matchInterface(expr.MetaKeyIIFNAME, dhcpIface.VMTAP),
+				matchPayload(expr.PayloadBaseLLHeader, 6, expr.CmpOpNeq, mac)...), dhcpv6Requests...)...)
+
+		// iifname <port> icmpv6 type nd-router-solicit counter drop
+		addRule(input, "router solicitation from the pod network",
+			append(matchInterface(expr.MetaKeyIIFNAME, port), matchICMPv6Type(ipv6.ICMPTypeRouterSolicitation)...)...)
+
+		// oifname <port> udp sport 547 counter drop
+		addRule(output, "DHCPv6 reply to the pod network",
+			append(matchInterface(expr.MetaKeyOIFNAME, port), matchUDPPort(0, dhcpv6ServerPort)...)...)
+
+		// oifname <port> icmpv6 type nd-router-advert counter drop
+		addRule(output, "router advertisement to the pod network",
+			append(matchInterface(expr.MetaKeyOIFNAME, port), matchICMPv6Type(ipv6.ICMPTypeRouterAdvertisement)...)...)
+	}
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to add the IPv6 isolation rules: %v", err)
+	}
+
+	changes.record(fmt.Sprintf("nftables bridge table %q", ipv6IsolationTableName), func() error {
+		conn := &nftables.Conn{}
+		conn.DelTable(table)
+
+		return conn.Flush()
+	})
+
+	return nil
+}
+
+// matchInterface returns the expressions matching the input or output interface
+func matchInterface(key expr.MetaKey, name string) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: key, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname(name)},
+	}
+}
+
+// matchUDPPort returns the expressions matching the UDP packets whose source or destination port, at the
+// given offset of the UDP header, is the given port
+func matchUDPPort(offset uint32, port uint16) []expr.Any {
+	return append([]expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_UDP}},
+	}, matchPayload(expr.PayloadBaseTransportHeader, offset, expr.CmpOpEq, binaryutil.BigEndian.PutUint16(port))...)
+}
+
+// matchICMPv6Type returns the expressions matching the ICMPv6 messages of the given type
+func matchICMPv6Type(icmpType ipv6.ICMPType) []expr.Any {
+	return append([]expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_ICMPV6}},
+	}, matchPayload(expr.PayloadBaseTransportHeader, 0, expr.CmpOpEq, []byte{byte(icmpType)})...)
+}
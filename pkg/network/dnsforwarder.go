@@ -0,0 +1,393 @@
+/*
+
+Copyright 2020 Salvatore Mazzarino
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// timeout of the queries to an upstream server
+	dnsUpstreamTimeout = 2 * time.Second
+
+	// TTL of the answers of the static hosts
+	dnsHostsTTL = 60
+
+	// bounds of the cache
+	dnsCacheMaxEntries = 10000
+	dnsCacheMaxTTL     = time.Hour
+)
+
+// DNSForwarder forwards the DNS queries of the guest to the DNS servers of the container, caching their
+// answers. The names with fewer dots than the ndots option of the container are looked up in its search
+// domains first, as the resolver of the container does, the guest resolver using ndots:1 by default.
+type DNSForwarder struct {
+	// Upstreams are the DNS servers of the container
+	Upstreams []string
+
+	// Hosts are the static host entries, by fully qualified name
+	Hosts map[string][]net.IP
+
+	search []string
+	ndots  int
+	cache  *dnsCache
+}
+
+// NewDNSForwarder returns a DNS forwarder to the given servers, following the search domains and the ndots
+// option of the container. The static hosts are given as "name=address".
+func NewDNSForwarder(upstreams []string, hosts []string) (*DNSForwarder, error) {
+	f := &DNSForwarder{
+		Upstreams: upstreams,
+		Hosts:     map[string][]net.IP{},
+		ndots:     1,
+		cache:     &dnsCache{entries: map[dns.Question]dnsCacheEntry{}},
+	}
+
+	for _, host := range hosts {
+		s := strings.SplitN(host, "=", 2)
+		if len(s) != 2 {
+			return nil, fmt.Errorf("invalid host %q, expected format is name=address", host)
+		}
+
+		ip := net.ParseIP(s[1])
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address of host %q", host)
+		}
+
+		f.AddHost(s[0], ip)
+	}
+
+	if containerConfig, err := dns.ClientConfigFromFile(resolvConfPath); err != nil {
+		log.Warningf("The DNS forwarder ignores the search domains of the container: %v", err)
+	} else {
+		for _, domain := range containerConfig.Search {
+			f.search = append(f.search, dns.Fqdn(strings.ToLower(domain)))
+		}
+
+		f.ndots = containerConfig.Ndots
+	}
+
+	return f, nil
+}
+
+// AddHost adds a static host entry
+func (f *DNSForwarder) AddHost(name string, ip net.IP) {
+	name = dns.Fqdn(strings.ToLower(name))
+	f.Hosts[name] = append(f.Hosts[name], ip)
+}
+
+// Start serves DNS over UDP and TCP on the given address
+func (f *DNSForwarder) Start(address string) error {
+	for _, network := range []string{"udp", "tcp"} {
+		server := &dns.Server{
+			Addr:    net.JoinHostPort(address, "53"),
+			Net:     network,
+			Handler: f,
+		}
+
+		started := make(chan struct{})
+		server.NotifyStartedFunc = func() { close(started) }
+
+		failed := make(chan error, 1)
+		go func() {
+			failed <- server.ListenAndServe()
+		}()
+
+		select {
+		case <-started:
+		case err := <-failed:
+			return fmt.Errorf("failed to listen on %s/%s: %v", server.Addr, network, err)
+		}
+	}
+
+	log.Infof("Starting DNS forwarder on %s to %s", address, strings.Join(f.Upstreams, ", "))
+
+	return nil
+}
+
+// ServeDNS answers a DNS query of the guest
+func (f *DNSForwarder) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	var resp *dns.Msg
+
+	if len(req.Question) != 1 {
+		resp = new(dns.Msg).SetRcodeFormatError(req)
+	} else if hostResp := f.answerHost(req); hostResp != nil {
+		resp = hostResp
+	} else {
+		resp = f.forward(req)
+	}
+
+	resp.Id = req.Id
+	resp.Question = req.Question
+
+	// the answers which do not fit in the UDP buffer of the guest are truncated
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size := dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+
+		resp.Truncate(size)
+	}
+
+	if err := w.WriteMsg(resp); err != nil {
+		log.Debugf("Failed to answer DNS query: %v", err)
+	}
+}
+
+// answerHost answers the queries for the static hosts
+func (f *DNSForwarder) answerHost(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+
+	ips, ok := f.Hosts[strings.ToLower(q.Name)]
+	if !ok || q.Qclass != dns.ClassINET {
+		return nil
+	}
+
+	resp := new(dns.Msg).SetReply(req)
+	resp.Authoritative = true
+	resp.RecursionAvailable = true
+
+	for _, ip := range ips {
+		hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: dnsHostsTTL}
+
+		switch {
+		case ip.To4() != nil && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY):
+			hdr.Rrtype = dns.TypeA
+			resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: ip.To4()})
+		case ip.To4() == nil && (q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY):
+			hdr.Rrtype = dns.TypeAAAA
+			resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+
+	return resp
+}
+
+// forward resolves the query through the upstream servers, trying the names in the search domains
+func (f *DNSForwarder) forward(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	names := f.names(q.Name)
+
+	var resp *dns.Msg
+
+	for i, name := range names {
+		question := dns.Question{Name: name, Qtype: q.Qtype, Qclass: q.Qclass}
+
+		r, err := f.lookup(req, question)
+		if err != nil {
+			log.Debugf("DNS lookup of %s failed: %v", name, err)
+
+			if i == len(names)-1 && resp == nil {
+				return new(dns.Msg).SetRcode(req, dns.RcodeServerFailure)
+			}
+
+			continue
+		}
+
+		resp = r
+
+		// the answers of the names in the search domains are given for the name of the query
+		for _, rr := range resp.Answer {
+			if strings.EqualFold(rr.Header().Name, name) {
+				rr.Header().Name = q.Name
+			}
+		}
+
+		if resp.Rcode != dns.RcodeNameError {
+			break
+		}
+	}
+
+	return resp
+}
+
+// names returns the names looked up for a query, following the search domains and ndots of the container
+func (f *DNSForwarder) names(name string) []string {
+	lower := strings.ToLower(name)
+	if lower == "." {
+		return []string{name}
+	}
+
+	for _, domain := range f.search {
+		if dns.IsSubDomain(domain, lower) {
+			return []string{name}
+		}
+	}
+
+	var expanded []string
+	for _, domain := range f.search {
+		expanded = append(expanded, name+domain)
+	}
+
+	// the names with enough dots are absolute names first
+	if dns.CountLabel(name)-1 >= f.ndots {
+		return append([]string{name}, expanded...)
+	}
+
+	return append(expanded, name)
+}
+
+// lookup returns the answer to a question from the cache or from the upstream servers
+func (f *DNSForwarder) lookup(req *dns.Msg, question dns.Question) (*dns.Msg, error) {
+	if resp := f.cache.get(question); resp != nil {
+		return resp, nil
+	}
+
+	m := req.Copy()
+	m.Question = []dns.Question{question}
+
+	resp, err := f.exchange(m)
+	if err != nil {
+		return nil, err
+	}
+
+	f.cache.set(question, resp)
+
+	return resp.Copy(), nil
+}
+
+// exchange sends the query to the upstream servers in turn, over TCP when the answer is truncated
+func (f *DNSForwarder) exchange(m *dns.Msg) (*dns.Msg, error) {
+	var lastErr error
+
+	for _, upstream := range f.Upstreams {
+		address := net.JoinHostPort(upstream, "53")
+
+		client := &dns.Client{Net: "udp", Timeout: dnsUpstreamTimeout}
+		resp, _, err := client.Exchange(m, address)
+		if err == nil && resp.Truncated {
+			client.Net = "tcp"
+			resp, _, err = client.Exchange(m, address)
+		}
+
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		return resp, nil
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no DNS server")
+	}
+
+	return nil, lastErr
+}
+
+// dnsCache caches the answers of the upstream servers for their TTL
+type dnsCache struct {
+	lock    sync.Mutex
+	entries map[dns.Question]dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	msg     *dns.Msg
+	created time.Time
+	expiry  time.Time
+}
+
+// get returns a copy of the cached answer, whose TTLs are decreased by the time spent in the cache
+func (c *dnsCache) get(question dns.Question) *dns.Msg {
+	question.Name = strings.ToLower(question.Name)
+
+	c.lock.Lock()
+	entry, ok := c.entries[question]
+	c.lock.Unlock()
+
+	now := time.Now()
+	if !ok || now.After(entry.expiry) {
+		return nil
+	}
+
+	msg := entry.msg.Copy()
+	elapsed := uint32(now.Sub(entry.created) / time.Second)
+
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+
+			if rr.Header().Ttl > elapsed {
+				rr.Header().Ttl -= elapsed
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+
+	return msg
+}
+
+// set caches the successful answers and the non-existent names for the lowest TTL of their records
+func (c *dnsCache) set(question dns.Question, msg *dns.Msg) {
+	if msg.Truncated || (msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError) {
+		return
+	}
+
+	var ttl time.Duration = dnsCacheMaxTTL
+	records := 0
+
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns} {
+		for _, rr := range section {
+			if t := time.Duration(rr.Header().Ttl) * time.Second; t < ttl {
+				ttl = t
+			}
+
+			records++
+		}
+	}
+
+	// the negative answers without SOA record are not cached, see RFC 2308
+	if records == 0 || ttl == 0 {
+		return
+	}
+
+	question.Name = strings.ToLower(question.Name)
+	now := time.Now()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.entries) >= dnsCacheMaxEntries {
+		for q, entry := range c.entries {
+			if now.After(entry.expiry) {
+				delete(c.entries, q)
+			}
+		}
+
+		if len(c.entries) >= dnsCacheMaxEntries {
+			return
+		}
+	}
+
+	c.entries[question] = dnsCacheEntry{
+		msg:     msg.Copy(),
+		created: now,
+		expiry:  now.Add(ttl),
+	}
+}
@@ -20,6 +20,8 @@ package network
 import (
 	"fmt"
 	"net"
+	"os"
+	"strings"
 
 	"github.com/giantswarm/containervmm/pkg/api"
 
@@ -27,6 +29,7 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
 // Array of container interfaces to ignore (not forward to vm)
@@ -34,21 +37,30 @@ var ignoreInterfaces = map[string]struct{}{
 	"lo": {},
 }
 
-func SetupInterfaces(guest *api.Guest) ([]DHCPInterface, error) {
+// SetupInterfaces hands the selected interfaces of the container to the guest. The changes made to the
+// interfaces are returned, to be reverted once the guest is gone.
+func SetupInterfaces(guest *api.Guest, filter InterfaceFilter) ([]DHCPInterface, *Changes, error) {
 	var dhcpIfaces []DHCPInterface
 	var nics []api.NetworkInterface
 
+	selector, err := filter.compile()
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid interface selection: %v", err)
+	}
+
 	netHandle, err := netlink.NewHandle()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer netHandle.Delete()
 
 	ifaces, err := net.Interfaces()
 	if err != nil || ifaces == nil || len(ifaces) == 0 {
-		return nil, fmt.Errorf("cannot get local network interfaces: %v", err)
+		return nil, nil, fmt.Errorf("cannot get local network interfaces: %v", err)
 	}
 
+	changes := &Changes{}
+
 	interfacesCount := 0
 	for _, iface := range ifaces {
 		// Skip the interface if it's ignored
@@ -56,62 +68,144 @@ func SetupInterfaces(guest *api.Guest) ([]DHCPInterface, error) {
 			continue
 		}
 
-		// Try to transfer the address from the container to the DHCP server
-		ipNet, gw, routes, _, err := takeAddress(netHandle, &iface)
+		// Leave the interfaces which are not selected to the container
+		if !selector.selected(iface.Name) {
+			log.Infof("Leaving interface %q to the container", iface.Name)
+			continue
+		}
+
+		// The changes made to the interface are reverted straight away
+		// if the interface cannot be handed to the guest
+		ifaceChanges := &Changes{}
+
+		// Try to transfer the addresses from the container to the guest
+		addrs, gw, routes, _, err := takeAddresses(netHandle, &iface, netlink.FAMILY_V4, ifaceChanges)
 		if err != nil {
-			// Log the problem, but don't quit the function here as there might be other good interfaces
-			log.Errorf("parsing interface %q failed: %w", iface.Name, err)
+			// Log the problem, the interface might still have IPv6 addresses
+			log.Warningf("parsing IPv4 addresses of interface %q failed: %v", iface.Name, err)
+		}
+
+		addrsv6, gwv6, routesv6, _, err := takeAddresses(netHandle, &iface, netlink.FAMILY_V6, ifaceChanges)
+		if err != nil {
+			log.Debugf("parsing IPv6 addresses of interface %q failed: %v", iface.Name, err)
+		}
+
+		if len(addrs) == 0 && len(addrsv6) == 0 {
+			// The Ethernet interfaces without addresses are handed to
+			// the guest as layer 2 links, which are not served over DHCP
+			if len(iface.HardwareAddr) != 6 {
+				// Log the problem, but don't quit the function here as there might be other good interfaces
+				log.Errorf("interface %q has no address to move to the guest", iface.Name)
+
+				// Try with the next interface
+				continue
+			}
+
+			log.Infof("Handing interface %q without addresses to the guest as a layer 2 link", iface.Name)
+		}
+
+		if guest.NetworkMode == api.NetworkModeMACVTAP {
+			nic, err := macvtap(netHandle, &iface, ifaceChanges)
+			if err != nil {
+				// Log the problem, but don't quit the function here as there might be other good interfaces
+				log.Errorf("creating macvtap on interface %q failed: %v", iface.Name, err)
+				ifaceChanges.Revert()
+				// Try with the next interface
+				continue
+			}
+
+			// DHCP cannot reach the guest through the macvtap, its
+			// network configuration is static
+			nic.GatewayIP = gw
+			nic.GatewayIPv6 = gwv6
+			nic.Addresses = append(addrs, addrsv6...)
+			nic.Routes = append(routes, routesv6...)
+			nic.StaticConfig = true
+
+			nics = append(nics, *nic)
+			changes.merge(ifaceChanges)
+
+			// This is an interface we care about
+			interfacesCount++
 
-			// Try with the next interface
 			continue
 		}
 
-		dhcpIface, err := bridge(netHandle, &iface)
+		dhcpIface, queues, err := bridge(netHandle, &iface, tapQueues(guest), ifaceChanges)
 		if err != nil {
 			// Log the problem, but don't quit the function here as there might be other good interfaces
 			// Don't set shouldRetry here as there is no point really with retrying with this interface
 			// that seems broken/unsupported in some way.
 			log.Errorf("bridging interface %q failed: %v", iface.Name, err)
+			ifaceChanges.Revert()
 			// Try with the next interface
 			continue
 		}
 
-		dhcpIface.VMIPNet = ipNet
+		// the primary addresses are served over DHCP, the secondary
+		// ones are set by the network configuration of the guest
+		if len(addrs) > 0 {
+			dhcpIface.VMIPNet = &addrs[0]
+		}
+
+		if len(addrsv6) > 0 {
+			dhcpIface.VMIPv6Net = &addrsv6[0]
+		}
+
 		dhcpIface.GatewayIP = gw
 		dhcpIface.Routes = routes
+		dhcpIface.GatewayIPv6 = gwv6
+		dhcpIface.RoutesV6 = routesv6
 
 		dhcpIfaces = append(dhcpIfaces, *dhcpIface)
 
 		// bind DHCP Network Interfaces to the Guest object
 		nics = append(nics, api.NetworkInterface{
 			GatewayIP:   gw,
-			InterfaceIP: &ipNet.IP,
-			Routes:      routes,
+			GatewayIPv6: gwv6,
+			Addresses:   append(addrs, addrsv6...),
+			Routes:      append(routes, routesv6...),
 			MacAddr:     dhcpIface.MACFilter,
 			TAP:         dhcpIface.VMTAP,
+			FDs:         queues,
+			MTU:         iface.MTU,
 		})
 
+		changes.merge(ifaceChanges)
+
 		// This is an interface we care about
 		interfacesCount++
 	}
 
 	if interfacesCount == 0 {
-		return nil, fmt.Errorf("no active or valid interfaces available yet")
+		return nil, nil, fmt.Errorf("no active or valid interfaces available yet")
+	}
+
+	if err := addIPv6IsolationRules(dhcpIfaces, changes); err != nil {
+		changes.Revert()
+
+		return nil, nil, err
 	}
 
+	openVhostNet(nics, changes)
+
 	guest.NICs = nics
 
-	return dhcpIfaces, nil
+	return dhcpIfaces, changes, nil
 }
 
-// takeAddress removes the first address of an interface and returns it and the appropriate gateway
-func takeAddress(netHandle *netlink.Handle, iface *net.Interface) (*net.IPNet, *net.IP, []netlink.Route, bool, error) {
+// takeAddresses removes all the addresses of the given family from an interface and returns them, the
+// primary address first, along with the appropriate gateway. Only global IPv6 addresses are taken, the
+// link-local ones are left to the container.
+func takeAddresses(netHandle *netlink.Handle, iface *net.Interface, family int, changes *Changes) ([]net.IPNet, *net.IP, []netlink.Route, bool, error) {
 	addrs, err := iface.Addrs()
 	if err != nil || addrs == nil || len(addrs) == 0 {
 		// set the bool to true so the caller knows to retry
 		return nil, nil, nil, true, fmt.Errorf("interface %q has no address", iface.Name)
 	}
 
+	var ipNets []net.IPNet
+
 	for _, addr := range addrs {
 		var ip net.IP
 		var mask net.IPMask
@@ -129,57 +223,81 @@ func takeAddress(netHandle *netlink.Handle, iface *net.Interface) (*net.IPNet, *
 			continue
 		}
 
-		ip = ip.To4()
-		if ip == nil {
+		if family == netlink.FAMILY_V4 {
+			ip = ip.To4()
+			if ip == nil {
+				continue
+			}
+		} else if ip.To4() != nil || !ip.IsGlobalUnicast() {
 			continue
 		}
 
-		link, err := netHandle.LinkByName(iface.Name)
-		if err != nil {
-			return nil, nil, nil, false, fmt.Errorf("failed to get interface %q by name: %v", iface.Name, err)
-		}
+		ipNets = append(ipNets, net.IPNet{
+			IP:   ip,
+			Mask: mask,
+		})
+	}
 
-		var gw *net.IP
-		routes, err := netHandle.RouteList(link, netlink.FAMILY_ALL)
-		if err != nil {
-			return nil, nil, nil, false, fmt.Errorf("failed to get default gateway for interface %q: %v", iface.Name, err)
-		}
-		for _, rt := range routes {
-			if rt.Gw != nil {
-				gw = &rt.Gw
-				break
-			}
+	if len(ipNets) == 0 {
+		return nil, nil, nil, false, fmt.Errorf("interface %s has no valid addresses", iface.Name)
+	}
+
+	link, err := netHandle.LinkByName(iface.Name)
+	if err != nil {
+		return nil, nil, nil, false, fmt.Errorf("failed to get interface %q by name: %v", iface.Name, err)
+	}
+
+	var gw *net.IP
+	routes, err := netHandle.RouteList(link, family)
+	if err != nil {
+		return nil, nil, nil, false, fmt.Errorf("failed to get default gateway for interface %q: %v", iface.Name, err)
+	}
+	for _, rt := range routes {
+		if rt.Gw != nil {
+			gw = &rt.Gw
+			break
 		}
+	}
 
+	// The routes going away along with the addresses are restored once
+	// the addresses are back
+	changes.record(fmt.Sprintf("removal of the routes of %q", iface.Name), func() error {
+		return restoreRoutes(routes)
+	})
+
+	// The secondary addresses are removed first, as removing the primary
+	// IPv4 address of a subnet removes its secondary addresses as well
+	for i := len(ipNets) - 1; i >= 0; i-- {
 		delAddr := &netlink.Addr{
-			IPNet: &net.IPNet{
-				IP:   ip,
-				Mask: mask,
-			},
+			IPNet: &ipNets[i],
 		}
 		if err = netHandle.AddrDel(link, delAddr); err != nil {
 			return nil, nil, nil, false, fmt.Errorf("failed to remove address %q from interface %q: %v", delAddr, iface.Name, err)
 		}
 
-		log.Infof("Moving IP address %s (%s) with gateway %s from container to guest", ip.String(), maskString(mask), gw.String())
+		changes.record(fmt.Sprintf("removal of address %s from %q", delAddr.IPNet, iface.Name), func() error {
+			return netlink.AddrAdd(link, delAddr)
+		})
 
-		return &net.IPNet{
-			IP:   ip,
-			Mask: mask,
-		}, gw, routes, false, nil
+		if gw == nil {
+			log.Infof("Moving IP address %s without gateway from container to guest", ipNets[i].String())
+		} else {
+			log.Infof("Moving IP address %s with gateway %s from container to guest", ipNets[i].String(), gw.String())
+		}
 	}
 
-	return nil, nil, nil, false, fmt.Errorf("interface %s has no valid addresses", iface.Name)
+	return ipNets, gw, routes, false, nil
 }
 
 // bridge creates the TAP device and performs the bridging, returning the base configuration for a DHCP server
-func bridge(netHandle *netlink.Handle, iface *net.Interface) (*DHCPInterface, error) {
+// and the queues of the TAP device
+func bridge(netHandle *netlink.Handle, iface *net.Interface, queues int, changes *Changes) (*DHCPInterface, []*os.File, error) {
 	tapName := "tap-" + iface.Name
 	bridgeName := "br-" + iface.Name
 
 	eth, err := netHandle.LinkByIndex(iface.Index)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Move the veth address to the TAP interface. This MAC address has to be
@@ -191,54 +309,154 @@ func bridge(netHandle *netlink.Handle, iface *net.Interface) (*DHCPInterface, er
 	// Generate the MAC addresses for the VM's adapters
 	randomMacAddr, err := util.GenerateRandomPrivateMacAddr()
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate MAC addresses: %v", err)
+		return nil, nil, fmt.Errorf("failed to generate MAC addresses: %v", err)
 	}
 
 	if err := netHandle.LinkSetHardwareAddr(eth, randomMacAddr); err != nil {
-		return nil, fmt.Errorf("failed to set MAC address %s for eth interface %s: %s",
+		return nil, nil, fmt.Errorf("failed to set MAC address %s for eth interface %s: %s",
 			randomMacAddr, eth.Attrs().Name, err)
 	}
 
-	tuntap, err := createTAPAdapter(netHandle, tapName, tapHardAddr)
+	changes.record(fmt.Sprintf("MAC address of %q", eth.Attrs().Name), func() error {
+		return netlink.LinkSetHardwareAddr(eth, tapHardAddr)
+	})
+
+	// the TAP and the bridge get the MTU of the interface, the larger
+	// packets of the guest would be dropped otherwise
+	tuntap, err := createTAPAdapter(netHandle, tapName, tapHardAddr, iface.MTU, queues, changes)
 	if err != nil {
-		return nil, fmt.Errorf("creation tap interface %q failed: %w", tapName, err)
+		return nil, nil, fmt.Errorf("creation tap interface %q failed: %w", tapName, err)
 	}
 
-	bridge, err := createBridge(netHandle, bridgeName)
+	bridge, err := createBridge(netHandle, bridgeName, iface.MTU, changes)
 	if err != nil {
-		return nil, fmt.Errorf("creation bridge %q failed: %w", bridgeName, err)
+		return nil, nil, fmt.Errorf("creation bridge %q failed: %w", bridgeName, err)
 	}
 
-	if err := setMaster(netHandle, bridge, tuntap, eth); err != nil {
-		return nil, fmt.Errorf("failed to set master: %v", err)
+	if err := setMaster(netHandle, bridge, changes, tuntap, eth); err != nil {
+		return nil, nil, fmt.Errorf("failed to set master: %v", err)
 	}
 
 	return &DHCPInterface{
 		VMTAP:  tapName,
 		Bridge: bridgeName,
+		MTU:    iface.MTU,
 		// Set the MAC address filter for the DHCP server
 		MACFilter: tapHardAddr.String(),
+	}, tuntap.Fds, nil
+}
+
+// interfaceName returns the name of the container interface of a NIC, or "nat" in nat network mode
+func interfaceName(nic api.NetworkInterface) string {
+	return strings.TrimPrefix(nic.TAP, "tap-")
+}
+
+// macvtap creates a macvtap device in passthru mode on top of the container interface and opens it for QEMU.
+// The device inherits the MAC address of the interface, which the guest keeps.
+func macvtap(netHandle *netlink.Handle, iface *net.Interface, changes *Changes) (*api.NetworkInterface, error) {
+	macvtapName := "mvtap-" + iface.Name
+
+	la := netlink.NewLinkAttrs()
+	la.Name = macvtapName
+	la.ParentIndex = iface.Index
+	la.MTU = iface.MTU
+
+	link := &netlink.Macvtap{
+		Macvlan: netlink.Macvlan{
+			LinkAttrs: la,
+			Mode:      netlink.MACVLAN_MODE_PASSTHRU,
+		},
+	}
+
+	if err := addLink(netHandle, link, changes); err != nil {
+		return nil, fmt.Errorf("creation macvtap interface %q failed: %v", macvtapName, err)
+	}
+
+	file, err := openMacvtap(macvtapName, changes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.NetworkInterface{
+		MacAddr: iface.HardwareAddr.String(),
+		TAP:     macvtapName,
+		MTU:     iface.MTU,
+		FDs:     []*os.File{file},
 	}, nil
 }
 
-// createTAPAdapter creates a new TAP device with the given name
-func createTAPAdapter(netHandle *netlink.Handle, tapName string, hardAddr net.HardwareAddr) (*netlink.Tuntap, error) {
+// openMacvtap opens the character device of a macvtap interface. The device
+// node is created when missing, as there is no udev in the container.
+func openMacvtap(macvtapName string, changes *Changes) (*os.File, error) {
+	iface, err := net.InterfaceByName(macvtapName)
+	if err != nil {
+		return nil, err
+	}
+
+	devPath := fmt.Sprintf("/dev/tap%d", iface.Index)
+
+	if _, err := os.Stat(devPath); os.IsNotExist(err) {
+		devNumbers, err := os.ReadFile(fmt.Sprintf("/sys/class/net/%s/macvtap/tap%d/dev", macvtapName, iface.Index))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get device numbers of %q: %v", macvtapName, err)
+		}
+
+		var major, minor uint32
+		if _, err := fmt.Sscanf(strings.TrimSpace(string(devNumbers)), "%d:%d", &major, &minor); err != nil {
+			return nil, fmt.Errorf("failed to parse device numbers of %q: %v", macvtapName, err)
+		}
+
+		if err := unix.Mknod(devPath, unix.S_IFCHR|0600, int(unix.Mkdev(major, minor))); err != nil {
+			return nil, fmt.Errorf("failed to create device %s: %v", devPath, err)
+		}
+
+		changes.record(fmt.Sprintf("creation of device %s", devPath), func() error {
+			return os.Remove(devPath)
+		})
+	}
+
+	file, err := os.OpenFile(devPath, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open device %s: %v", devPath, err)
+	}
+
+	changes.record(fmt.Sprintf("opening of device %s", devPath), file.Close)
+
+	return file, nil
+}
+
+// createTAPAdapter creates a new TAP device with the given name. The queues of the device are opened for
+// QEMU, with the virtio-net header offloading the checksums and the segmentation to the guest.
+func createTAPAdapter(netHandle *netlink.Handle, tapName string, hardAddr net.HardwareAddr, mtu, queues int, changes *Changes) (*netlink.Tuntap, error) {
 	la := netlink.NewLinkAttrs()
 	la.Name = tapName
 	la.HardwareAddr = hardAddr
+	la.MTU = mtu
 
 	tuntap := &netlink.Tuntap{
 		LinkAttrs: la,
 		Mode:      netlink.TUNTAP_MODE_TAP,
+		Flags:     netlink.TUNTAP_MULTI_QUEUE_DEFAULTS | netlink.TUNTAP_VNET_HDR,
+		Queues:    queues,
+	}
+
+	if err := netHandle.LinkAdd(tuntap); err != nil {
+		return nil, err
 	}
 
-	return tuntap, addLink(netHandle, tuntap)
+	// the queues are closed once the device is gone
+	changes.record(fmt.Sprintf("opening of the queues of %q", tapName), func() error {
+		return closeFiles(tuntap.Fds)
+	})
+
+	return tuntap, setupLink(netHandle, tuntap, changes)
 }
 
 // createBridge creates a new bridge device with the given name
-func createBridge(netHandle *netlink.Handle, bridgeName string) (*netlink.Bridge, error) {
+func createBridge(netHandle *netlink.Handle, bridgeName string, mtu int, changes *Changes) (*netlink.Bridge, error) {
 	la := netlink.NewLinkAttrs()
 	la.Name = bridgeName
+	la.MTU = mtu
 
 	// Disable MAC address age tracking. This causes issues in the container,
 	// the bridge is unable to resolve MACs from outside resulting in it never
@@ -247,33 +465,63 @@ func createBridge(netHandle *netlink.Handle, bridgeName string) (*netlink.Bridge
 	// taking any performance hit by disabling it here.
 	ageingTime := uint32(0)
 	bridge := &netlink.Bridge{LinkAttrs: la, AgeingTime: &ageingTime}
-	return bridge, addLink(netHandle, bridge)
+	return bridge, addLink(netHandle, bridge, changes)
 }
 
-// addLink creates the given link and brings it up
-func addLink(netHandle *netlink.Handle, link netlink.Link) (err error) {
-	if err = netHandle.LinkAdd(link); err == nil {
-		err = netHandle.LinkSetUp(link)
+// addLink creates the given link with its MTU and brings it up
+func addLink(netHandle *netlink.Handle, link netlink.Link, changes *Changes) (err error) {
+	if err = netHandle.LinkAdd(link); err != nil {
+		return
+	}
+
+	return setupLink(netHandle, link, changes)
+}
+
+// setupLink sets the MTU of a new link and brings it up
+func setupLink(netHandle *netlink.Handle, link netlink.Link, changes *Changes) (err error) {
+	changes.record(fmt.Sprintf("creation of %q", link.Attrs().Name), func() error {
+		return netlink.LinkDel(link)
+	})
+
+	// the MTU is not set on creation for all the link types, such as the TAP devices
+	if mtu := link.Attrs().MTU; mtu > 0 {
+		if err = netHandle.LinkSetMTU(link, mtu); err != nil {
+			return fmt.Errorf("failed to set MTU %d: %v", mtu, err)
+		}
 	}
 
-	return
+	return netHandle.LinkSetUp(link)
 }
 
-func setMaster(netHandle *netlink.Handle, master netlink.Link, links ...netlink.Link) error {
+func setMaster(netHandle *netlink.Handle, master netlink.Link, changes *Changes, links ...netlink.Link) error {
 	masterIndex := master.Attrs().Index
 	for _, link := range links {
 		if err := netHandle.LinkSetMasterByIndex(link, masterIndex); err != nil {
 			return err
 		}
+
+		link := link
+		changes.record(fmt.Sprintf("enslavement of %q", link.Attrs().Name), func() error {
+			return netlink.LinkSetNoMaster(link)
+		})
 	}
 
 	return nil
 }
 
-func maskString(mask net.IPMask) string {
-	if len(mask) < 4 {
-		return "<nil>"
+// restoreRoutes adds back the routes which are missing
+func restoreRoutes(routes []netlink.Route) error {
+	var failed []string
+
+	for i := range routes {
+		if err := netlink.RouteReplace(&routes[i]); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", routes[i], err))
+		}
 	}
 
-	return fmt.Sprintf("%d.%d.%d.%d", mask[0], mask[1], mask[2], mask[3])
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+
+	return nil
 }
@@ -0,0 +1,167 @@
+/*
+
+Copyright 2020 Salvatore Mazzarino
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// errNoNamespace is returned when the network namespace cannot be created, such as without CAP_SYS_ADMIN
+var errNoNamespace = errors.New("failed to create network namespace")
+
+// inNetworkNamespace runs f in a new network namespace. The OS thread is left locked, so that it exits
+// along with the goroutine instead of being reused by other goroutines in the namespace.
+func inNetworkNamespace(f func() error) error {
+	errs := make(chan error)
+
+	go func() {
+		runtime.LockOSThread()
+
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			errs <- fmt.Errorf("%w: %v", errNoNamespace, err)
+			return
+		}
+
+		errs <- f()
+	}()
+
+	return <-errs
+}
+
+func TestTakeAddresses(t *testing.T) {
+	testCases := []struct {
+		name    string
+		addrs   []string
+		gateway string
+	}{
+		{
+			name:  "address without gateway",
+			addrs: []string{"10.0.0.2/24"},
+		},
+		{
+			name:    "address with gateway",
+			addrs:   []string{"10.0.0.2/24"},
+			gateway: "10.0.0.1",
+		},
+		{
+			name:    "secondary addresses",
+			addrs:   []string{"10.0.0.2/24", "10.0.0.3/24"},
+			gateway: "10.0.0.1",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := inNetworkNamespace(func() error {
+				netHandle, err := netlink.NewHandle()
+				if err != nil {
+					return err
+				}
+				defer netHandle.Delete()
+
+				la := netlink.NewLinkAttrs()
+				la.Name = "eth0"
+
+				link := &netlink.Bridge{LinkAttrs: la}
+				if err := netHandle.LinkAdd(link); err != nil {
+					return err
+				}
+
+				if err := netHandle.LinkSetUp(link); err != nil {
+					return err
+				}
+
+				for _, a := range tc.addrs {
+					addr, err := netlink.ParseAddr(a)
+					if err != nil {
+						return err
+					}
+
+					if err := netHandle.AddrAdd(link, addr); err != nil {
+						return err
+					}
+				}
+
+				if tc.gateway != "" {
+					if err := netHandle.RouteAdd(&netlink.Route{
+						LinkIndex: link.Attrs().Index,
+						Gw:        net.ParseIP(tc.gateway),
+					}); err != nil {
+						return err
+					}
+				}
+
+				iface, err := net.InterfaceByName(la.Name)
+				if err != nil {
+					return err
+				}
+
+				changes := &Changes{}
+
+				ipNets, gw, _, _, err := takeAddresses(netHandle, iface, netlink.FAMILY_V4, changes)
+				if err != nil {
+					return err
+				}
+
+				if len(ipNets) != len(tc.addrs) {
+					return fmt.Errorf("expected addresses %v, got %v", tc.addrs, ipNets)
+				}
+
+				for i, a := range tc.addrs {
+					if ipNets[i].String() != a {
+						return fmt.Errorf("expected addresses %v, got %v", tc.addrs, ipNets)
+					}
+				}
+
+				switch {
+				case tc.gateway == "" && gw != nil:
+					return fmt.Errorf("expected no gateway, got %s", gw)
+				case tc.gateway != "" && (gw == nil || !gw.Equal(net.ParseIP(tc.gateway))):
+					return fmt.Errorf("expected gateway %s, got %v", tc.gateway, gw)
+				}
+
+				if addrs, err := netHandle.AddrList(link, netlink.FAMILY_V4); err != nil || len(addrs) != 0 {
+					return fmt.Errorf("expected the addresses to be removed, got %v, %v", addrs, err)
+				}
+
+				changes.Revert()
+
+				if addrs, err := netHandle.AddrList(link, netlink.FAMILY_V4); err != nil || len(addrs) != len(tc.addrs) {
+					return fmt.Errorf("expected the addresses to be restored, got %v, %v", addrs, err)
+				}
+
+				return nil
+			})
+
+			if errors.Is(err, errNoNamespace) {
+				t.Skip(err)
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+/*
+
+Copyright 2020 Salvatore Mazzarino
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// lease is the lease of the address of the guest on an interface
+type lease struct {
+	MAC string `json:"mac"`
+	IP  net.IP `json:"ip"`
+
+	// Expiry is the end of the lease, zero for an infinite lease
+	Expiry time.Time `json:"expiry"`
+}
+
+// expired returns true if the lease ended
+func (l *lease) expired() bool {
+	return !l.Expiry.IsZero() && time.Now().After(l.Expiry)
+}
+
+// leaseStore keeps the lease of the guest on an interface, persisted in the
+// state directory so that it survives the restarts of containervmm
+type leaseStore struct {
+	path string
+
+	lock    sync.Mutex
+	current *lease
+}
+
+// loadLeaseStore loads the lease of the interface from the state directory.
+// A lease of another MAC or address, left by a previous incarnation of the
+// pod, is dropped.
+func loadLeaseStore(stateDir, bridge, mac string, ip net.IP) (*leaseStore, error) {
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %v", err)
+	}
+
+	s := &leaseStore{
+		path: filepath.Join(stateDir, fmt.Sprintf("dhcp-lease-%s.json", bridge)),
+	}
+
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read lease: %v", err)
+	}
+
+	var l lease
+	if err := json.Unmarshal(data, &l); err != nil {
+		log.Warningf("%q dropping unreadable DHCP lease: %v", bridge, err)
+		return s, nil
+	}
+
+	switch {
+	case l.MAC != mac || !l.IP.Equal(ip):
+		log.Infof("%q dropping DHCP lease of %s for %s, the guest address changed", bridge, l.IP, l.MAC)
+	case l.expired():
+		log.Infof("%q dropping DHCP lease of %s expired at %s", bridge, l.IP, l.Expiry.Format(time.RFC3339))
+	default:
+		log.Infof("%q resuming DHCP lease of %s for %s", bridge, l.IP, l.MAC)
+		s.current = &l
+	}
+
+	return s, nil
+}
+
+// valid returns true if the client holds an unexpired lease of the address, granted by this server or
+// resumed from the state directory
+func (s *leaseStore) valid(mac string, ip net.IP) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.current != nil && s.current.MAC == mac && s.current.IP.Equal(ip) && !s.current.expired()
+}
+
+// grant records the lease of the address for the given duration, zero for an infinite lease
+func (s *leaseStore) grant(mac string, ip net.IP, duration time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.current = &lease{
+		MAC: mac,
+		IP:  ip,
+	}
+
+	if duration > 0 {
+		s.current.Expiry = time.Now().Add(duration)
+	}
+
+	data, err := json.Marshal(s.current)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.path, data)
+}
+
+// writeFileAtomic replaces a file with the given data through a temporary file, synced before being
+// renamed, so that a crash leaves either the previous or the new file but never a truncated one
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// release drops the lease
+func (s *leaseStore) release() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.current = nil
+
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
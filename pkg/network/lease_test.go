@@ -0,0 +1,155 @@
+/*
+
+Copyright 2020 Salvatore Mazzarino
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadLeaseStore(t *testing.T) {
+	testCases := []struct {
+		name string
+
+		// lease file left by a previous run, none if empty
+		data string
+
+		wantLease bool
+	}{
+		{
+			name: "no lease",
+		},
+		{
+			name:      "infinite lease",
+			data:      `{"mac":"02:42:ac:11:00:02","ip":"10.0.0.2","expiry":"0001-01-01T00:00:00Z"}`,
+			wantLease: true,
+		},
+		{
+			name:      "unexpired lease",
+			data:      `{"mac":"02:42:ac:11:00:02","ip":"10.0.0.2","expiry":"2999-01-01T00:00:00Z"}`,
+			wantLease: true,
+		},
+		{
+			name: "expired lease",
+			data: `{"mac":"02:42:ac:11:00:02","ip":"10.0.0.2","expiry":"2000-01-01T00:00:00Z"}`,
+		},
+		{
+			name: "lease of another MAC",
+			data: `{"mac":"02:42:ac:11:00:03","ip":"10.0.0.2","expiry":"0001-01-01T00:00:00Z"}`,
+		},
+		{
+			name: "lease of another address",
+			data: `{"mac":"02:42:ac:11:00:02","ip":"10.0.0.3","expiry":"0001-01-01T00:00:00Z"}`,
+		},
+		{
+			name: "truncated lease",
+			data: `{"mac":"02:42:ac:11:00:02","ip":"10.0`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			if tc.data != "" {
+				if err := os.WriteFile(filepath.Join(dir, "dhcp-lease-br-eth0.json"), []byte(tc.data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			s, err := loadLeaseStore(dir, "br-eth0", testGuestMAC.String(), testGuestIP)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if valid := s.valid(testGuestMAC.String(), testGuestIP); valid != tc.wantLease {
+				t.Errorf("expected the lease to be resumed %t, got %t", tc.wantLease, valid)
+			}
+		})
+	}
+}
+
+func TestLeaseStore(t *testing.T) {
+	testCases := []struct {
+		name     string
+		duration time.Duration
+		release  bool
+
+		wantLease bool
+	}{
+		{
+			name:      "infinite lease",
+			wantLease: true,
+		},
+		{
+			name:      "finite lease",
+			duration:  time.Hour,
+			wantLease: true,
+		},
+		{
+			name:     "released lease",
+			duration: time.Hour,
+			release:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			s, err := loadLeaseStore(dir, "br-eth0", testGuestMAC.String(), testGuestIP)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := s.grant(testGuestMAC.String(), testGuestIP, tc.duration); err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.release {
+				if err := s.release(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if valid := s.valid(testGuestMAC.String(), testGuestIP); valid != tc.wantLease {
+				t.Errorf("expected a lease %t, got %t", tc.wantLease, valid)
+			}
+
+			if s.valid(testOtherMAC.String(), testGuestIP) || s.valid(testGuestMAC.String(), testOtherIP) {
+				t.Errorf("expected no lease of another MAC or address")
+			}
+
+			// the lease survives a restart
+			s, err = loadLeaseStore(dir, "br-eth0", testGuestMAC.String(), testGuestIP)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if valid := s.valid(testGuestMAC.String(), testGuestIP); valid != tc.wantLease {
+				t.Errorf("expected the lease to be resumed %t, got %t", tc.wantLease, valid)
+			}
+
+			if _, err := os.Stat(filepath.Join(dir, "dhcp-lease-br-eth0.json.tmp")); !os.IsNotExist(err) {
+				t.Errorf("expected no temporary lease file, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,333 @@
+/*
+
+Copyright 2020 Salvatore Mazzarino
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/giantswarm/containervmm/pkg/api"
+	"github.com/giantswarm/containervmm/pkg/util"
+)
+
+const (
+	natBridgeName = "br-nat"
+	natTAPName    = "tap-nat"
+
+	// nftables table holding the rules of containervmm
+	nftablesTableName = "containervmm"
+
+	ipForwardPath = "/proc/sys/net/ipv4/ip_forward"
+)
+
+// SetupNAT connects the guest to a private subnet behind a bridge of the container. The traffic of the guest
+// is masqueraded with the addresses of the container, which keeps its interfaces, and the published ports of
+// the container are forwarded to the guest. The changes made to the container are returned, to be reverted
+// once the guest is gone.
+func SetupNAT(guest *api.Guest, subnet *net.IPNet) ([]DHCPInterface, *Changes, error) {
+	ones, bits := subnet.Mask.Size()
+	if subnet.IP.To4() == nil || bits != 32 || ones > 30 {
+		return nil, nil, fmt.Errorf("invalid NAT subnet %s, an IPv4 subnet of at least 4 addresses is needed", subnet)
+	}
+
+	// the bridge has the first address of the subnet, the guest the second one
+	network := binary.BigEndian.Uint32(subnet.IP.To4())
+	gatewayIP := make(net.IP, 4)
+	binary.BigEndian.PutUint32(gatewayIP, network+1)
+	guestIP := make(net.IP, 4)
+	binary.BigEndian.PutUint32(guestIP, network+2)
+
+	netHandle, err := netlink.NewHandle()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer netHandle.Delete()
+
+	guestMAC, err := util.GenerateRandomPrivateMacAddr()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate MAC address: %v", err)
+	}
+
+	mtu := defaultRouteMTU(netHandle)
+	changes := &Changes{}
+
+	queues, err := createNATBridge(netHandle, guestMAC, &net.IPNet{IP: gatewayIP, Mask: subnet.Mask}, mtu, tapQueues(guest), changes)
+	if err != nil {
+		changes.Revert()
+		return nil, nil, err
+	}
+
+	if err := enableIPForwarding(changes); err != nil {
+		changes.Revert()
+		return nil, nil, err
+	}
+
+	if err := addNATRules(subnet, guestIP, guest.PortMappings, changes); err != nil {
+		changes.Revert()
+		return nil, nil, fmt.Errorf("failed to add the NAT rules: %v", err)
+	}
+
+	guestIPNet := net.IPNet{IP: guestIP, Mask: subnet.Mask}
+
+	log.Infof("Connecting the guest to %s behind %q, with address %s", subnet, natBridgeName, guestIP)
+
+	dhcpIface := DHCPInterface{
+		VMIPNet:   &guestIPNet,
+		GatewayIP: &gatewayIP,
+		VMTAP:     natTAPName,
+		Bridge:    natBridgeName,
+		MTU:       mtu,
+		MACFilter: guestMAC.String(),
+	}
+
+	guest.NICs = []api.NetworkInterface{
+		{
+			GatewayIP: &gatewayIP,
+			Addresses: []net.IPNet{guestIPNet},
+			MacAddr:   guestMAC.String(),
+			TAP:       natTAPName,
+			FDs:       queues,
+			MTU:       mtu,
+		},
+	}
+
+	openVhostNet(guest.NICs, changes)
+
+	return []DHCPInterface{dhcpIface}, changes, nil
+}
+
+// createNATBridge creates the bridge of the private subnet, holding the address of the gateway, and the TAP
+// device of the guest, whose queues are returned
+func createNATBridge(netHandle *netlink.Handle, guestMAC net.HardwareAddr, gateway *net.IPNet, mtu, queues int, changes *Changes) ([]*os.File, error) {
+	tuntap, err := createTAPAdapter(netHandle, natTAPName, guestMAC, mtu, queues, changes)
+	if err != nil {
+		return nil, fmt.Errorf("creation tap interface %q failed: %w", natTAPName, err)
+	}
+
+	bridge, err := createBridge(netHandle, natBridgeName, mtu, changes)
+	if err != nil {
+		return nil, fmt.Errorf("creation bridge %q failed: %w", natBridgeName, err)
+	}
+
+	if err := setMaster(netHandle, bridge, changes, tuntap); err != nil {
+		return nil, fmt.Errorf("failed to set master: %v", err)
+	}
+
+	// the address goes away along with the bridge
+	if err := netHandle.AddrAdd(bridge, &netlink.Addr{IPNet: gateway}); err != nil {
+		return nil, fmt.Errorf("failed to add address %s to bridge %q: %v", gateway, natBridgeName, err)
+	}
+
+	return tuntap.Fds, nil
+}
+
+// defaultRouteMTU returns the MTU of the interface of the IPv4 default route of the container
+func defaultRouteMTU(netHandle *netlink.Handle) int {
+	routes, err := netHandle.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		log.Warningf("Failed to list the routes of the container: %v", err)
+		return 0
+	}
+
+	for _, route := range routes {
+		if route.Dst != nil {
+			continue
+		}
+
+		link, err := netHandle.LinkByIndex(route.LinkIndex)
+		if err != nil {
+			break
+		}
+
+		return link.Attrs().MTU
+	}
+
+	return 0
+}
+
+// enableIPForwarding enables the forwarding of the IPv4 packets in the network namespace of the container
+func enableIPForwarding(changes *Changes) error {
+	value, err := os.ReadFile(ipForwardPath)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", ipForwardPath, err)
+	}
+
+	if strings.TrimSpace(string(value)) == "1" {
+		return nil
+	}
+
+	if err := os.WriteFile(ipForwardPath, []byte("1"), 0644); err != nil {
+		return fmt.Errorf("failed to enable IP forwarding, the net.ipv4.ip_forward sysctl of the pod can be set instead: %v", err)
+	}
+
+	changes.record("IP forwarding", func() error {
+		return os.WriteFile(ipForwardPath, value, 0644)
+	})
+
+	return nil
+}
+
+// addNATRules adds the nftables rules masquerading the traffic of the subnet and forwarding the published
+// ports to the guest. The ports of the addresses of the container are forwarded from the other hosts and
+// from the other containers of the pod, but not from the loopback addresses.
+func addNATRules(subnet *net.IPNet, guestIP net.IP, portMappings []api.PortMapping, changes *Changes) error {
+	conn := &nftables.Conn{}
+
+	table := conn.AddTable(&nftables.Table{
+		Name:   nftablesTableName,
+		Family: nftables.TableFamilyIPv4,
+	})
+
+	prerouting := conn.AddChain(&nftables.Chain{
+		Name:     "prerouting",
+		Table:    table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityNATDest,
+	})
+
+	output := conn.AddChain(&nftables.Chain{
+		Name:     "output",
+		Table:    table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookOutput,
+		Priority: nftables.ChainPriorityNATDest,
+	})
+
+	postrouting := conn.AddChain(&nftables.Chain{
+		Name:     "postrouting",
+		Table:    table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	})
+
+	for _, pm := range portMappings {
+		fromOutside, fromContainer := publishRules(pm, guestIP)
+
+		conn.AddRule(&nftables.Rule{
+			Table: table,
+			Chain: prerouting,
+			Exprs: fromOutside,
+		})
+
+		conn.AddRule(&nftables.Rule{
+			Table: table,
+			Chain: output,
+			Exprs: fromContainer,
+		})
+	}
+
+	// ip saddr <subnet> oifname != "br-nat" masquerade
+	conn.AddRule(&nftables.Rule{
+		Table: table,
+		Chain: postrouting,
+		Exprs: []expr.Any{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+			&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: subnet.Mask, Xor: []byte{0, 0, 0, 0}},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: subnet.IP.To4()},
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: ifname(natBridgeName)},
+			&expr.Masq{},
+		},
+	})
+
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+
+	changes.record(fmt.Sprintf("nftables table %q", nftablesTableName), func() error {
+		conn := &nftables.Conn{}
+		conn.DelTable(table)
+
+		return conn.Flush()
+	})
+
+	return nil
+}
+
+// publishRules returns the expressions of the rules of the prerouting and output chains forwarding a
+// published port to the guest. Only the connections to the addresses of the container are forwarded, the
+// connections opened by the container to the same port of other hosts are left alone.
+func publishRules(pm api.PortMapping, guestIP net.IP) ([]expr.Any, []expr.Any) {
+	// iifname != "br-nat"
+	fromOutside := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: ifname(natBridgeName)},
+	}
+
+	// ip daddr != 127.0.0.0/8
+	fromContainer := []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: []byte{255, 0, 0, 0}, Xor: []byte{0, 0, 0, 0}},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{127, 0, 0, 0}},
+	}
+
+	// fib daddr type local
+	local := []expr.Any{
+		&expr.Fib{Register: 1, FlagDADDR: true, ResultADDRTYPE: true},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(unix.RTN_LOCAL)},
+	}
+
+	fromOutside = append(append(fromOutside, local...), publishExprs(pm, guestIP)...)
+	fromContainer = append(append(fromContainer, local...), publishExprs(pm, guestIP)...)
+
+	return fromOutside, fromContainer
+}
+
+// publishExprs returns the expressions forwarding a published port to the guest:
+// meta l4proto <protocol> th dport <host port> dnat to <guest>:<guest port>
+func publishExprs(pm api.PortMapping, guestIP net.IP) []expr.Any {
+	protocol := byte(unix.IPPROTO_TCP)
+	if pm.Protocol == api.ProtocolUDP {
+		protocol = unix.IPPROTO_UDP
+	}
+
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{protocol}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(pm.HostPort))},
+		&expr.Immediate{Register: 1, Data: guestIP.To4()},
+		&expr.Immediate{Register: 2, Data: binaryutil.BigEndian.PutUint16(uint16(pm.GuestPort))},
+		&expr.NAT{
+			Type:        expr.NATTypeDestNAT,
+			Family:      unix.NFPROTO_IPV4,
+			RegAddrMin:  1,
+			RegProtoMin: 2,
+		},
+	}
+}
+
+// ifname returns the name of an interface as matched by nftables
+func ifname(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name)
+
+	return b
+}
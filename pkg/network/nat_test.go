@@ -0,0 +1,105 @@
+/*
+
+Copyright 2020 Salvatore Mazzarino
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+
+	"github.com/giantswarm/containervmm/pkg/api"
+)
+
+func TestPublishRules(t *testing.T) {
+	guestIP := net.IPv4(192, 168, 122, 2)
+
+	notBridge := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte("br-nat\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")},
+	}
+
+	notLoopback := []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: []byte{255, 0, 0, 0}, Xor: []byte{0, 0, 0, 0}},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{127, 0, 0, 0}},
+	}
+
+	local := []expr.Any{
+		&expr.Fib{Register: 1, FlagDADDR: true, ResultADDRTYPE: true},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(unix.RTN_LOCAL)},
+	}
+
+	dnat := func(protocol byte, hostPort, guestPort []byte) []expr.Any {
+		return []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{protocol}},
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: hostPort},
+			&expr.Immediate{Register: 1, Data: []byte{192, 168, 122, 2}},
+			&expr.Immediate{Register: 2, Data: guestPort},
+			&expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV4, RegAddrMin: 1, RegProtoMin: 2},
+		}
+	}
+
+	concat := func(exprs ...[]expr.Any) []expr.Any {
+		var all []expr.Any
+		for _, e := range exprs {
+			all = append(all, e...)
+		}
+
+		return all
+	}
+
+	testCases := []struct {
+		name              string
+		portMapping       api.PortMapping
+		wantFromOutside   []expr.Any
+		wantFromContainer []expr.Any
+	}{
+		{
+			name:              "tcp",
+			portMapping:       api.PortMapping{HostPort: 443, GuestPort: 443, Protocol: api.ProtocolTCP},
+			wantFromOutside:   concat(notBridge, local, dnat(unix.IPPROTO_TCP, []byte{1, 187}, []byte{1, 187})),
+			wantFromContainer: concat(notLoopback, local, dnat(unix.IPPROTO_TCP, []byte{1, 187}, []byte{1, 187})),
+		},
+		{
+			name:              "udp",
+			portMapping:       api.PortMapping{HostPort: 5353, GuestPort: 53, Protocol: api.ProtocolUDP},
+			wantFromOutside:   concat(notBridge, local, dnat(unix.IPPROTO_UDP, []byte{20, 233}, []byte{0, 53})),
+			wantFromContainer: concat(notLoopback, local, dnat(unix.IPPROTO_UDP, []byte{20, 233}, []byte{0, 53})),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fromOutside, fromContainer := publishRules(tc.portMapping, guestIP)
+
+			if !reflect.DeepEqual(fromOutside, tc.wantFromOutside) {
+				t.Errorf("expected prerouting rule %#v, got %#v", tc.wantFromOutside, fromOutside)
+			}
+
+			if !reflect.DeepEqual(fromContainer, tc.wantFromContainer) {
+				t.Errorf("expected output rule %#v, got %#v", tc.wantFromContainer, fromContainer)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+/*
+
+Copyright 2020 Salvatore Mazzarino
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/giantswarm/containervmm/pkg/api"
+	"github.com/giantswarm/containervmm/pkg/ignition"
+)
+
+// directory of the systemd-networkd units in the guest
+const networkdDir = "/etc/systemd/network"
+
+// NetworkdUnits returns the systemd-networkd units configuring the guest
+// NICs with a static configuration or without addresses, and the addresses
+// of the other NICs which are not served over DHCP. The units sort before the default unit
+// of the distro, which they replace for the NICs they match.
+func NetworkdUnits(nics []api.NetworkInterface, dnsServers, ntpServers, searchDomains []string) []ignition.File {
+	var files []ignition.File
+
+	for _, nic := range nics {
+		var unit strings.Builder
+
+		unit.WriteString("[Match]\n")
+		fmt.Fprintf(&unit, "MACAddress=%s\n", nic.MacAddr)
+
+		switch {
+		case len(nic.Addresses) == 0:
+			// layer 2 links are brought up without any address
+			unit.WriteString("\n[Link]\n")
+			unit.WriteString("RequiredForOnline=no\n")
+
+			unit.WriteString("\n[Network]\n")
+			unit.WriteString("LinkLocalAddressing=no\n")
+			unit.WriteString("IPv6AcceptRA=no\n")
+		case nic.StaticConfig:
+			writeStaticNetwork(&unit, nic, dnsServers, ntpServers, searchDomains)
+		default:
+			secondaries := secondaryAddresses(nic.Addresses)
+			if len(secondaries) == 0 {
+				continue
+			}
+
+			unit.WriteString("\n[Network]\n")
+			unit.WriteString("DHCP=yes\n")
+
+			for _, addr := range secondaries {
+				unit.WriteString("\n[Address]\n")
+				fmt.Fprintf(&unit, "Address=%s\n", addr.String())
+			}
+		}
+
+		files = append(files, ignition.File{
+			Path:     fmt.Sprintf("%s/00-containervmm-%s.network", networkdDir, nic.TAP),
+			Mode:     0644,
+			Contents: unit.String(),
+		})
+	}
+
+	return files
+}
+
+// writeStaticNetwork writes the addresses, routes and servers of the NIC.
+// The gateways are on-link, as they are often outside of the subnet of
+// the container (i.e. 169.254.1.1 with Calico).
+func writeStaticNetwork(unit *strings.Builder, nic api.NetworkInterface, dnsServers, ntpServers, searchDomains []string) {
+	unit.WriteString("\n[Network]\n")
+
+	// the guest gets no router advertisements
+	unit.WriteString("IPv6AcceptRA=no\n")
+
+	for _, addr := range nic.Addresses {
+		fmt.Fprintf(unit, "Address=%s\n", addr.String())
+	}
+
+	for _, server := range dnsServers {
+		fmt.Fprintf(unit, "DNS=%s\n", server)
+	}
+
+	if len(searchDomains) > 0 {
+		fmt.Fprintf(unit, "Domains=%s\n", strings.Join(searchDomains, " "))
+	}
+
+	for _, server := range ntpServers {
+		fmt.Fprintf(unit, "NTP=%s\n", server)
+	}
+
+	for _, gw := range []*net.IP{nic.GatewayIP, nic.GatewayIPv6} {
+		if gw != nil {
+			unit.WriteString("\n[Route]\n")
+			fmt.Fprintf(unit, "Gateway=%s\n", gw.String())
+			unit.WriteString("GatewayOnLink=yes\n")
+		}
+	}
+
+	// the default routes are set by the gateways
+	for _, route := range nic.Routes {
+		if route.Dst == nil || route.Gw == nil {
+			continue
+		}
+
+		unit.WriteString("\n[Route]\n")
+		fmt.Fprintf(unit, "Destination=%s\n", route.Dst.String())
+		fmt.Fprintf(unit, "Gateway=%s\n", route.Gw.String())
+		unit.WriteString("GatewayOnLink=yes\n")
+	}
+}
+
+// secondaryAddresses returns the addresses following the first address of
+// their family
+func secondaryAddresses(addrs []net.IPNet) []net.IPNet {
+	var secondaries []net.IPNet
+	var hasIPv4, hasIPv6 bool
+
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			if hasIPv4 {
+				secondaries = append(secondaries, addr)
+			}
+
+			hasIPv4 = true
+		} else {
+			if hasIPv6 {
+				secondaries = append(secondaries, addr)
+			}
+
+			hasIPv6 = true
+		}
+	}
+
+	return secondaries
+}
@@ -0,0 +1,231 @@
+/*
+
+Copyright 2020 Salvatore Mazzarino
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// interval between the unsolicited router advertisements
+	raInterval = 3 * time.Minute
+
+	// lifetime of the default route of the guest, in seconds
+	raRouterLifetime = 1800
+
+	// ICMPv6 option types, see RFC 4861, RFC 4191 and RFC 8106
+	ndOptionPrefixInformation = 3
+	ndOptionRouteInformation  = 24
+	ndOptionRDNSS             = 25
+
+	raFlagManaged = 0x80
+	raFlagOther   = 0x40
+
+	prefixFlagOnLink = 0x80
+)
+
+// StartRouterAdvertisements advertises the gateway of the container to the
+// guest. The advertisements tell the guest to get its address over DHCPv6
+// and they are sent in the name of the gateway, so that the guest reaches
+// it directly. The gateway does not advertise itself, the container being
+// its only neighbour on the link. The advertisements and the solicitations
+// are kept off the network of the pod by addIPv6IsolationRules.
+func (i *DHCPInterface) StartRouterAdvertisements() error {
+	bridge, err := net.InterfaceByName(i.Bridge)
+	if err != nil {
+		return err
+	}
+
+	source := &net.IPAddr{IP: net.IPv6unspecified}
+	lifetime := uint16(raRouterLifetime)
+
+	switch {
+	case i.GatewayIPv6 == nil:
+		// the network is only reachable on-link
+		lifetime = 0
+	case i.GatewayIPv6.IsLinkLocalUnicast():
+		source.IP = *i.GatewayIPv6
+		source.Zone = i.Bridge
+	default:
+		// the guest only accepts advertisements from link-local addresses
+		log.Warningf("%q IPv6 gateway %s is not link-local, the guest gets no IPv6 default route", i.Bridge, i.GatewayIPv6)
+		lifetime = 0
+	}
+
+	sender, err := listenICMPv6(i.Bridge, source.String())
+	if err != nil {
+		return fmt.Errorf("failed to open router advertisement socket: %v", err)
+	}
+	defer sender.Close()
+
+	if err := sender.SetMulticastHopLimit(255); err != nil {
+		return err
+	}
+
+	solicitations, err := listenICMPv6(i.Bridge, "::")
+	if err != nil {
+		return fmt.Errorf("failed to open router solicitation socket: %v", err)
+	}
+	defer solicitations.Close()
+
+	var filter ipv6.ICMPFilter
+	filter.SetAll(true)
+	filter.Accept(ipv6.ICMPTypeRouterSolicitation)
+
+	if err := solicitations.SetICMPFilter(&filter); err != nil {
+		return err
+	}
+
+	if err := solicitations.JoinGroup(bridge, &net.IPAddr{IP: net.IPv6linklocalallrouters}); err != nil {
+		return fmt.Errorf("failed to join all routers multicast group: %v", err)
+	}
+
+	ra := i.routerAdvertisement(lifetime)
+	dst := &net.IPAddr{IP: net.IPv6linklocalallnodes, Zone: i.Bridge}
+
+	// answer the solicitations sent by the guest when it boots
+	solicited := make(chan error)
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			if _, _, _, err := solicitations.ReadFrom(buffer); err != nil {
+				solicited <- err
+				return
+			}
+
+			solicited <- nil
+		}
+	}()
+
+	ticker := time.NewTicker(raInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := sender.WriteTo(ra, nil, dst); err != nil {
+			log.Warningf("%q failed to send router advertisement: %v", i.Bridge, err)
+		}
+
+		select {
+		case <-ticker.C:
+		case err := <-solicited:
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// routerAdvertisement builds the router advertisement. The advertisement
+// holds no source link-layer address, the guest resolves the address of
+// the gateway through the container.
+func (i *DHCPInterface) routerAdvertisement(lifetime uint16) []byte {
+	// the checksum is computed by the kernel
+	ra := make([]byte, 16)
+	ra[0] = byte(ipv6.ICMPTypeRouterAdvertisement)
+	ra[4] = 64
+	ra[5] = raFlagManaged | raFlagOther
+	binary.BigEndian.PutUint16(ra[6:8], lifetime)
+
+	// the prefix is on-link, but the address is assigned over DHCPv6 only
+	if ones, bits := i.VMIPv6Net.Mask.Size(); ones < bits {
+		prefix := make([]byte, 32)
+		prefix[0] = ndOptionPrefixInformation
+		prefix[1] = 4
+		prefix[2] = byte(ones)
+		prefix[3] = prefixFlagOnLink
+		binary.BigEndian.PutUint32(prefix[4:8], dhcpv6Infinity)
+		binary.BigEndian.PutUint32(prefix[8:12], dhcpv6Infinity)
+		copy(prefix[16:], i.VMIPv6Net.IP.Mask(i.VMIPv6Net.Mask).To16())
+
+		ra = append(ra, prefix...)
+	}
+
+	// the routes through the gateway other than the default route
+	for _, route := range i.RoutesV6 {
+		if route.Dst == nil || i.GatewayIPv6 == nil || !route.Gw.Equal(*i.GatewayIPv6) {
+			continue
+		}
+
+		ones, _ := route.Dst.Mask.Size()
+		if ones == 0 {
+			continue
+		}
+
+		info := make([]byte, 24)
+		info[0] = ndOptionRouteInformation
+		info[1] = 3
+		info[2] = byte(ones)
+		binary.BigEndian.PutUint32(info[4:8], dhcpv6Infinity)
+		copy(info[8:], route.Dst.IP.To16())
+
+		ra = append(ra, info...)
+	}
+
+	if len(i.dnsServersV6) > 0 {
+		rdnss := make([]byte, 8)
+		rdnss[0] = ndOptionRDNSS
+		rdnss[1] = byte(1 + 2*len(i.dnsServersV6))
+		binary.BigEndian.PutUint32(rdnss[4:8], dhcpv6Infinity)
+
+		for _, server := range i.dnsServersV6 {
+			rdnss = append(rdnss, server.To16()...)
+		}
+
+		ra = append(ra, rdnss...)
+	}
+
+	return ra
+}
+
+// listenICMPv6 opens an ICMPv6 socket on the given interface. The socket
+// can be bound to an address the container does not have, such as the
+// address of the gateway.
+func listenICMPv6(ifaceName string, address string) (*ipv6.PacketConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			if err := bindToDevice(ifaceName)(network, address, c); err != nil {
+				return err
+			}
+
+			var err error
+			if ctrlErr := c.Control(func(fd uintptr) {
+				err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, unix.IPV6_FREEBIND, 1)
+			}); ctrlErr != nil {
+				return ctrlErr
+			}
+
+			return err
+		},
+	}
+
+	conn, err := lc.ListenPacket(context.Background(), "ip6:ipv6-icmp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return ipv6.NewPacketConn(conn), nil
+}
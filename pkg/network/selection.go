@@ -0,0 +1,235 @@
+/*
+
+Copyright 2020 Salvatore Mazzarino
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// annotations holding the status of the networks attached by Multus, the
+// second one being used by the older releases
+var multusStatusAnnotations = []string{
+	"k8s.v1.cni.cncf.io/network-status",
+	"k8s.v1.cni.cncf.io/networks-status",
+}
+
+// InterfaceFilter selects the interfaces of the container handed to the
+// guest. The interfaces which are not selected are left untouched.
+type InterfaceFilter struct {
+	// Include are the patterns of the names of the interfaces to select.
+	// If empty, all the interfaces are selected.
+	Include []string
+
+	// Exclude are the patterns of the names of the interfaces to leave
+	// in the container, which take precedence over the included ones
+	Exclude []string
+
+	// MultusNetworks are the names of the Multus networks whose
+	// interfaces are selected, along with the included ones
+	MultusNetworks []string
+
+	// MultusAnnotations is the file holding the annotations of the pod,
+	// exposed by the downward API, where Multus reports the interfaces
+	// of the networks
+	MultusAnnotations string
+}
+
+// interfaceSelector is the compiled form of an InterfaceFilter
+type interfaceSelector struct {
+	include []nameMatcher
+	exclude []nameMatcher
+	multus  map[string]struct{}
+}
+
+type nameMatcher func(name string) bool
+
+// compile compiles the patterns and resolves the interfaces of the Multus
+// networks. A pattern is either a glob or a regular expression enclosed
+// in slashes (i.e. "eth*", "/^net[0-9]+$/").
+func (f InterfaceFilter) compile() (*interfaceSelector, error) {
+	var err error
+	s := &interfaceSelector{}
+
+	if s.include, err = compilePatterns(f.Include); err != nil {
+		return nil, err
+	}
+
+	if s.exclude, err = compilePatterns(f.Exclude); err != nil {
+		return nil, err
+	}
+
+	if len(f.MultusNetworks) > 0 {
+		if s.multus, err = multusInterfaces(f.MultusAnnotations, f.MultusNetworks); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// selected returns true if the interface is handed to the guest
+func (s *interfaceSelector) selected(name string) bool {
+	for _, match := range s.exclude {
+		if match(name) {
+			return false
+		}
+	}
+
+	if len(s.include) == 0 && s.multus == nil {
+		return true
+	}
+
+	if _, ok := s.multus[name]; ok {
+		return true
+	}
+
+	for _, match := range s.include {
+		if match(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func compilePatterns(patterns []string) ([]nameMatcher, error) {
+	var matchers []nameMatcher
+
+	for _, p := range patterns {
+		glob := p
+
+		if len(p) > 1 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/") {
+			re, err := regexp.Compile(p[1 : len(p)-1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid regular expression %q: %v", p, err)
+			}
+
+			matchers = append(matchers, re.MatchString)
+
+			continue
+		}
+
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %v", p, err)
+		}
+
+		matchers = append(matchers, func(name string) bool {
+			matched, _ := path.Match(glob, name)
+			return matched
+		})
+	}
+
+	return matchers, nil
+}
+
+// multusNetworkStatus is an entry of the network status annotation
+type multusNetworkStatus struct {
+	Name      string `json:"name"`
+	Interface string `json:"interface"`
+}
+
+// multusInterfaces returns the interfaces of the given Multus networks,
+// which are named either "namespace/name" or "name"
+func multusInterfaces(annotationsFile string, networks []string) (map[string]struct{}, error) {
+	status, err := readAnnotation(annotationsFile, multusStatusAnnotations)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []multusNetworkStatus
+	if err := json.Unmarshal([]byte(status), &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse Multus network status: %v", err)
+	}
+
+	interfaces := map[string]struct{}{}
+
+	for _, network := range networks {
+		found := false
+
+		for _, entry := range entries {
+			if entry.Interface == "" {
+				continue
+			}
+
+			name := entry.Name
+			if !strings.Contains(network, "/") {
+				name = name[strings.LastIndex(name, "/")+1:]
+			}
+
+			if name == network {
+				interfaces[entry.Interface] = struct{}{}
+				found = true
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("no interface of Multus network %q in the network status", network)
+		}
+	}
+
+	return interfaces, nil
+}
+
+// readAnnotation returns the value of the first annotation found among the
+// given keys in a file written by the downward API, whose lines are in the
+// form key="value"
+func readAnnotation(annotationsFile string, keys []string) (string, error) {
+	file, err := os.Open(annotationsFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read pod annotations: %v", err)
+	}
+	defer file.Close()
+
+	annotations := map[string]string{}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		value, err := strconv.Unquote(kv[1])
+		if err != nil {
+			continue
+		}
+
+		annotations[kv[0]] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to read pod annotations: %v", err)
+	}
+
+	for _, key := range keys {
+		if value, ok := annotations[key]; ok {
+			return value, nil
+		}
+	}
+
+	return "", fmt.Errorf("annotation %s not found in %s", keys[0], annotationsFile)
+}
@@ -0,0 +1,103 @@
+/*
+
+Copyright 2020 Salvatore Mazzarino
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/giantswarm/containervmm/pkg/api"
+)
+
+const (
+	vhostNetPath = "/dev/vhost-net"
+
+	// maximum number of queues of a TAP device
+	maxTAPQueues = 256
+)
+
+// tapQueues returns the number of queues of the TAP devices, one per vCPU of the guest
+func tapQueues(guest *api.Guest) int {
+	cpus, err := strconv.Atoi(guest.CPUs)
+	if err != nil || cpus < 1 {
+		return 1
+	}
+
+	if cpus > maxTAPQueues {
+		return maxTAPQueues
+	}
+
+	return cpus
+}
+
+// openVhostNet opens a vhost-net device per queue of the NICs, which moves their datapath from QEMU to the
+// kernel. When vhost-net is not available, such as when the device is not exposed to the container, the
+// datapath stays in QEMU.
+func openVhostNet(nics []api.NetworkInterface, changes *Changes) {
+	for i := range nics {
+		nic := &nics[i]
+
+		vhostFDs, err := openVhostNetQueues(len(nic.FDs), changes)
+		if err != nil {
+			log.Warningf("The datapath of %q is handled by QEMU, vhost-net is not available: %v", nic.TAP, err)
+			continue
+		}
+
+		nic.VhostFDs = vhostFDs
+	}
+}
+
+// openVhostNetQueues opens the given number of vhost-net devices
+func openVhostNetQueues(queues int, changes *Changes) ([]*os.File, error) {
+	var files []*os.File
+
+	for i := 0; i < queues; i++ {
+		file, err := os.OpenFile(vhostNetPath, os.O_RDWR, 0)
+		if err != nil {
+			for _, file := range files {
+				file.Close()
+			}
+
+			return nil, err
+		}
+
+		files = append(files, file)
+	}
+
+	changes.record(fmt.Sprintf("opening of %d %s devices", queues, vhostNetPath), func() error {
+		return closeFiles(files)
+	})
+
+	return files, nil
+}
+
+// closeFiles closes the given files, returning the first error
+func closeFiles(files []*os.File) error {
+	var firstErr error
+
+	for _, file := range files {
+		if err := file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
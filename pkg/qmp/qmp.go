@@ -0,0 +1,174 @@
+/*
+
+Copyright 2020 Salvatore Mazzarino
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package qmp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// Client is a minimal client of the QEMU Machine Protocol. Unlike the govmm
+// QMP implementation it is able to execute arbitrary commands, and it can
+// also talk to the QEMU guest agent, which uses the same wire format.
+type Client struct {
+	conn    net.Conn
+	decoder *json.Decoder
+}
+
+type request struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+type response struct {
+	Return json.RawMessage `json:"return"`
+	Error  *Error          `json:"error"`
+	Event  string          `json:"event"`
+}
+
+// Error is an error returned by QEMU in reply to a command
+type Error struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Class, e.Desc)
+}
+
+// Dial connects to the QMP socket of QEMU, reads the greeting and
+// negotiates the capabilities so that commands can be executed
+func Dial(ctx context.Context, path string) (*Client, error) {
+	c, err := dial(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	// QEMU greets every new client before accepting commands
+	var greeting map[string]interface{}
+	if err := c.read(ctx, &greeting); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("failed to read QMP greeting: %v", err)
+	}
+
+	if err := c.Execute(ctx, "qmp_capabilities", nil, nil); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("failed to negotiate QMP capabilities: %v", err)
+	}
+
+	return c, nil
+}
+
+// DialGuestAgent connects to the socket of the QEMU guest agent. The agent
+// does not greet its clients, so the stream is synchronized with guest-sync
+// to discard any stale reply left by a previous client.
+func DialGuestAgent(ctx context.Context, path string) (*Client, error) {
+	c, err := dial(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	id := rand.Int63n(1 << 31)
+
+	var synced int64
+	if err := c.Execute(ctx, "guest-sync", map[string]interface{}{"id": id}, &synced); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("failed to synchronize with the guest agent: %v", err)
+	}
+
+	if synced != id {
+		c.Close()
+		return nil, fmt.Errorf("guest agent replied to sync %d with %d", id, synced)
+	}
+
+	return c, nil
+}
+
+func dial(ctx context.Context, path string) (*Client, error) {
+	var d net.Dialer
+
+	conn, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		conn:    conn,
+		decoder: json.NewDecoder(conn),
+	}, nil
+}
+
+// Execute runs the given command and decodes its return value into result,
+// which can be nil when the caller is not interested in it
+func (c *Client) Execute(ctx context.Context, command string, args interface{}, result interface{}) error {
+	if err := c.setDeadline(ctx); err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(c.conn).Encode(request{Execute: command, Arguments: args}); err != nil {
+		return fmt.Errorf("failed to send %s command: %v", command, err)
+	}
+
+	for {
+		var resp response
+		if err := c.read(ctx, &resp); err != nil {
+			return fmt.Errorf("failed to read %s response: %v", command, err)
+		}
+
+		// asynchronous events are interleaved with the responses
+		if resp.Event != "" {
+			continue
+		}
+
+		if resp.Error != nil {
+			return resp.Error
+		}
+
+		if result == nil || resp.Return == nil {
+			return nil
+		}
+
+		return json.Unmarshal(resp.Return, result)
+	}
+}
+
+// Close closes the connection to the socket
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) read(ctx context.Context, v interface{}) error {
+	if err := c.setDeadline(ctx); err != nil {
+		return err
+	}
+
+	return c.decoder.Decode(v)
+}
+
+func (c *Client) setDeadline(ctx context.Context) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Time{}
+	}
+
+	return c.conn.SetDeadline(deadline)
+}